@@ -3,6 +3,7 @@ import Router, { route, Route } from 'preact-router';
 import { useEffect } from 'preact/hooks';
 import { AdminPage } from './pages/admin';
 import LoginPage from './pages/login';
+import { PlaybackPage } from './pages/playback';
 import { TestPage } from './pages/test';
 import { Viewer } from './pages/viewer';
 import { useStore } from './services/store';
@@ -63,6 +64,7 @@ const App = () => {
       <Route path='/test' component={TestPage} />
       <ProtectedRoute path='/viewer' component={Viewer} />
       <AdminRoute path='/admin' component={AdminPage} />
+      <AdminRoute path='/playback' component={PlaybackPage} />
     </Router>
   );
 };
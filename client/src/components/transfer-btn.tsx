@@ -0,0 +1,88 @@
+import { h } from 'preact';
+import { useEffect, useState } from 'preact/hooks';
+import qs from 'query-string';
+
+const formatSize = (bytes: number) => {
+  if (bytes < 1024) return `${bytes} B`;
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KiB`;
+  return `${(bytes / 1024 / 1024).toFixed(1)} MiB`;
+};
+
+/**
+ * Lists the files shared with the sandbox, the sandbox sees them as a drive
+ * or through SFTP. Files can be uploaded, downloaded and deleted.
+ */
+export const TransferButton = () => {
+  const [open, setOpen] = useState(false);
+  const [list, setList] = useState<TransferList | null>(null);
+  const [status, setStatus] = useState('');
+
+  async function refresh() {
+    const res = await fetch('/api/transfer/files');
+    const body = await res.json();
+    if (!res.ok) {
+      setStatus(body.message);
+      return;
+    }
+    setList(body);
+  }
+
+  useEffect(() => {
+    if (open) refresh();
+  }, [open]);
+
+  async function onChange(e: Event) {
+    const input = e.target as HTMLInputElement;
+    const file = input.files?.[0];
+    input.value = '';
+    if (!file) return;
+
+    setStatus(`Uploading ${file.name}...`);
+    const res = await fetch('/api/transfer/files?' + qs.stringify({ name: file.name }), { method: 'POST', body: file });
+    const body = await res.json();
+    setStatus(res.ok ? `Uploaded ${file.name}` : `Upload failed: ${body.message}`);
+    refresh();
+  }
+
+  async function onDelete(name: string) {
+    const res = await fetch('/api/transfer/files/' + encodeURIComponent(name), { method: 'DELETE' });
+    if (!res.ok) {
+      const body = await res.json();
+      setStatus(`Delete failed: ${body.message}`);
+    }
+    refresh();
+  }
+
+  return (
+    <div className='relative'>
+      <button className='px-3 py-1 rounded-b-md bg-gray-700 hover:bg-gray-800 text-white text-sm' onClick={() => setOpen(!open)}>
+        Files
+      </button>
+      {!open ? null : (
+        <div className='absolute right-0 mt-1 w-80 p-2 rounded-md bg-white shadow-lg text-sm'>
+          {list?.files.map((file) => (
+            <div className='flex items-center gap-2 py-1' key={file.name}>
+              <a className='flex-1 truncate text-blue-600 hover:underline' href={'/api/transfer/files/' + encodeURIComponent(file.name)}>
+                {file.name}
+              </a>
+              <span className='text-gray-500'>{formatSize(file.size)}</span>
+              <button className='text-red-600 hover:underline' onClick={() => onDelete(file.name)}>
+                Delete
+              </button>
+            </div>
+          ))}
+          {list ? (
+            <div className='py-1 text-gray-500'>
+              {formatSize(list.usage)} of {formatSize(list.quota)} used
+            </div>
+          ) : null}
+          <label className='block mt-1 px-2 py-1 rounded bg-gray-700 hover:bg-gray-800 text-white text-center cursor-pointer'>
+            Upload file
+            <input type='file' className='hidden' onChange={onChange} />
+          </label>
+          {status ? <div className='mt-1 text-gray-500'>{status}</div> : null}
+        </div>
+      )}
+    </div>
+  );
+};
@@ -0,0 +1,49 @@
+import { h } from 'preact';
+import { useEffect, useState } from 'preact/hooks';
+import { DEFAULT_CHANNEL, FileEvent, SerialForwarder } from '../services/serial-forwarder';
+
+interface Props {
+  forwarder: SerialForwarder;
+}
+
+/**
+ * Uploads a file, such as a UF2 or a script for the board, to the sandbox
+ */
+export const UploadButton = ({ forwarder }: Props) => {
+  const [status, setStatus] = useState('');
+
+  useEffect(() => {
+    function onFile(event: FileEvent) {
+      if (event.type === 'progress' && event.size) {
+        setStatus(`Uploading ${event.name}: ${Math.round(((event.written || 0) / event.size) * 100)}%`);
+      }
+    }
+    forwarder.addListener('file', onFile);
+    return () => {
+      forwarder.removeListener('file', onFile);
+    };
+  }, [forwarder]);
+
+  async function onChange(e: Event) {
+    const input = e.target as HTMLInputElement;
+    const file = input.files?.[0];
+    input.value = '';
+    if (!file) return;
+
+    setStatus(`Uploading ${file.name}...`);
+    try {
+      const result = await forwarder.upload(file);
+      setStatus(`Uploaded to ${result.path}`);
+    } catch (err) {
+      setStatus(`Upload failed: ${(err as Error).message}`);
+    }
+  }
+
+  const label = forwarder.channel === DEFAULT_CHANNEL ? 'Upload file' : `Upload file (${forwarder.channel})`;
+  return (
+    <label className='px-3 py-1 rounded-b-md bg-gray-700 hover:bg-gray-800 text-white text-sm cursor-pointer' title={status}>
+      {status || label}
+      <input type='file' className='hidden' onChange={onChange} />
+    </label>
+  );
+};
@@ -4,17 +4,18 @@ import { useEffect } from 'preact/hooks';
 import { useStore } from '../../services/store';
 import { SandboxTable } from './sandboxTable';
 import { CommandBar } from './commandBar';
+import { RecordingsTable } from './recordingsTable';
+import { GuacdTable } from './guacdTable';
 
 export const AdminPage = () => {
-  const fetchAdminSummary = useStore((state) => state.fetchAdminSummary);
+  const subscribeAdminEvents = useStore((state) => state.subscribeAdminEvents);
 
   useEffect(() => {
-    fetchAdminSummary();
-    const intervalID = setInterval(() => fetchAdminSummary(), 5000);
+    const unsubscribe = subscribeAdminEvents();
 
     // Cleanup
     return () => {
-      clearInterval(intervalID);
+      unsubscribe();
     };
   }, []);
 
@@ -45,6 +46,10 @@ export const AdminPage = () => {
 
           <div className='w-1/3 min-h-[16rem]'>
             <h2 className='text-xl border-b'>Diagnostics</h2>
+            <h3 className='text-lg mt-4'>Guacd</h3>
+            <GuacdTable />
+            <h3 className='text-lg mt-4'>Recordings</h3>
+            <RecordingsTable />
           </div>
         </div>
       </div>
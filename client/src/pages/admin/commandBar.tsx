@@ -1,4 +1,5 @@
 import { h } from 'preact';
+import { useState } from 'preact/hooks';
 import { useStore } from '../../services/store';
 
 const colors = {
@@ -27,6 +28,8 @@ const Button = ({ value, baseColor, disabled = false, onClick }: ButtonProps) =>
 export const CommandBar = () => {
   const destroySession = useStore((state) => state.destroySession);
   const assignSandbox = useStore((state) => state.assignSandbox);
+  const pushHandout = useStore((state) => state.pushHandout);
+  const [handoutStatus, setHandoutStatus] = useState('');
 
   const session = useStore((state) => state.selectedSession);
   const sandbox = useStore((state) => state.selectedSandbox);
@@ -35,6 +38,22 @@ export const CommandBar = () => {
     window.open(`/viewer?hostname=${sandbox.ip}`);
   }
 
+  async function onHandout(e: Event) {
+    const input = e.target as HTMLInputElement;
+    const file = input.files?.[0];
+    input.value = '';
+    if (!file) return;
+
+    setHandoutStatus(`Pushing ${file.name}...`);
+    try {
+      const result = await pushHandout(file);
+      const failed = Object.keys(result.failed).length;
+      setHandoutStatus(`Pushed ${file.name} to ${result.delivered.length} groups` + (failed ? `, ${failed} failed` : ''));
+    } catch (err) {
+      setHandoutStatus(`Push failed: ${(err as Error).message}`);
+    }
+  }
+
   return (
     <div className='flex gap-2'>
       <Button
@@ -55,6 +74,11 @@ export const CommandBar = () => {
         disabled={sandbox === null}
         onClick={() => sandbox && openViewer(sandbox)}
       />
+      <label className='bg-blue-500 hover:bg-blue-700 text-white p-1 text-sm rounded cursor-pointer'>
+        Push handout
+        <input type='file' className='hidden' onChange={onHandout} />
+      </label>
+      {handoutStatus ? <span className='p-1 text-sm text-gray-500'>{handoutStatus}</span> : null}
     </div>
   );
 };
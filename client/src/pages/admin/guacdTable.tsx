@@ -0,0 +1,33 @@
+import { h } from 'preact';
+import { useStore } from '../../services/store';
+
+interface EntryProps {
+  guacd: Guacd;
+}
+const Entry = ({ guacd }: EntryProps) => {
+  const { addr, active, connections, health, lastError } = guacd;
+
+  return (
+    <div className='grid grid-cols-1 p-2 hover:bg-gray-100'>
+      <span className='text-xl font-light'>{addr}</span>
+      <span className={`text-sm ${health === 'unhealthy' ? 'text-red-600' : 'text-gray-500'}`} title={lastError}>
+        {health}
+      </span>
+      <span className='text-sm text-gray-500'>
+        {active} active, {connections} total
+      </span>
+    </div>
+  );
+};
+
+export const GuacdTable = () => {
+  const guacds = useStore((state) => state.adminSummary?.guacds);
+
+  return (
+    <div className='flex flex-col w-full'>
+      {guacds?.map((guacd) => (
+        <Entry guacd={guacd} />
+      ))}
+    </div>
+  );
+};
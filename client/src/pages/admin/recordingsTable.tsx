@@ -0,0 +1,50 @@
+import { h } from 'preact';
+import { useEffect } from 'preact/hooks';
+import { useStore } from '../../services/store';
+
+const formatTime = (unix: number) => new Date(unix * 1000).toLocaleString();
+
+interface EntryProps {
+  recording: Recording;
+}
+const Entry = ({ recording }: EntryProps) => {
+  const { id, groupName, startedAt, endedAt } = recording;
+
+  return (
+    <div className='grid grid-cols-1 p-2 hover:bg-gray-100'>
+      <span className='text-xl font-light'>{groupName}</span>
+      <span className='text-sm text-gray-500'>
+        {formatTime(startedAt)}
+        {endedAt ? ` - ${formatTime(endedAt)}` : ' (recording)'}
+      </span>
+      <span className='flex gap-2 text-sm'>
+        <a className='text-blue-600 hover:underline' href={`/playback?id=${id}`} target='_blank'>
+          Play
+        </a>
+        <a className='text-blue-600 hover:underline' href={`/api/admin/recordings/${id}`}>
+          Download
+        </a>
+      </span>
+    </div>
+  );
+};
+
+export const RecordingsTable = () => {
+  const recordings = useStore((state) => state.recordings);
+  const fetchRecordings = useStore((state) => state.fetchRecordings);
+
+  useEffect(() => {
+    fetchRecordings();
+  }, []);
+
+  return (
+    <div className='flex flex-col w-full'>
+      {recordings
+        .slice()
+        .reverse()
+        .map((recording) => (
+          <Entry key={recording.id} recording={recording} />
+        ))}
+    </div>
+  );
+};
@@ -11,7 +11,7 @@ interface EntryProps {
   onClick?: () => void;
 }
 const Entry = ({ sandbox, selected, onClick }: EntryProps) => {
-  const { ip, sessionID } = sandbox;
+  const { ip, sessionID, health, lastError, agents } = sandbox;
 
   return (
     <div
@@ -20,6 +20,14 @@ const Entry = ({ sandbox, selected, onClick }: EntryProps) => {
     >
       <span className='text-xl font-light'>{ip}</span>
       <span className='text-sm'>{sessionID}</span>
+      <span className={`text-sm ${health === 'unhealthy' ? 'text-red-600' : 'text-gray-500'}`} title={lastError}>
+        {health}
+      </span>
+      {agents?.map((agent) => (
+        <span className='text-sm text-gray-500'>
+          {agent.channel} {agent.connected ? 'connected' : 'idle'}, {agent.deviceBytes} B in, {agent.sandboxBytes} B out
+        </span>
+      ))}
     </div>
   );
 };
@@ -0,0 +1,63 @@
+import { h } from 'preact';
+import { useEffect, useRef, useState } from 'preact/hooks';
+import Guacamole from 'guacamole-common-js';
+import qs from 'query-string';
+
+const formatPosition = (ms: number) => {
+  const seconds = Math.floor(ms / 1000);
+  return `${Math.floor(seconds / 60)}:${String(seconds % 60).padStart(2, '0')}`;
+};
+
+export const PlaybackPage = () => {
+  const containerRef = useRef<HTMLDivElement>(null);
+  const [recording, setRecording] = useState<Guacamole.SessionRecording>();
+  const [playing, setPlaying] = useState(false);
+  const [position, setPosition] = useState(0);
+  const [duration, setDuration] = useState(0);
+
+  useEffect(() => {
+    const { id } = qs.parse(location.search);
+    if (!id || !containerRef.current) return;
+
+    const tunnel = new Guacamole.StaticHTTPTunnel(`/api/admin/recordings/${id}/stream`, false, {});
+    const rec = new Guacamole.SessionRecording(tunnel);
+    rec.onprogress = (d) => setDuration(d);
+    rec.onplay = () => setPlaying(true);
+    rec.onpause = () => setPlaying(false);
+    rec.onseek = (p) => setPosition(p);
+
+    containerRef.current.appendChild(rec.getDisplay().getElement());
+    rec.connect();
+    setRecording(rec);
+
+    // Cleanup
+    return () => {
+      rec.disconnect();
+    };
+  }, []);
+
+  return (
+    <div className='flex flex-col w-full h-screen'>
+      <div className='flex items-center gap-4 w-full border-b p-2'>
+        <button
+          className='bg-blue-500 hover:bg-blue-700 text-white p-1 text-sm rounded'
+          onClick={() => (playing ? recording?.pause() : recording?.play())}
+        >
+          {playing ? 'Pause' : 'Play'}
+        </button>
+        <input
+          className='flex-grow'
+          type='range'
+          min={0}
+          max={duration}
+          value={position}
+          onChange={(e) => recording?.seek(Number((e.target as HTMLInputElement).value))}
+        />
+        <span className='text-sm text-gray-500'>
+          {formatPosition(position)} / {formatPosition(duration)}
+        </span>
+      </div>
+      <div className='flex-grow overflow-auto' ref={containerRef} />
+    </div>
+  );
+};
@@ -2,12 +2,24 @@ import { h, Fragment } from 'preact';
 import { useEffect, useState } from 'preact/hooks';
 import { Display } from '../components/display';
 import { ConnectButton, State } from '../components/connect-btn';
-import { ConnectOpts, RemoteDesktop } from '../services/remote-desktop';
-import { SerialForwarder } from '../services/serial-forwarder';
+import { UploadButton } from '../components/upload-btn';
+import { TransferButton } from '../components/transfer-btn';
+import { RemoteDesktop, requestConnection } from '../services/remote-desktop';
+import { DEFAULT_CHANNEL, SerialForwarder } from '../services/serial-forwarder';
 import Guacamole from 'guacamole-common-js';
 import qs from 'query-string';
-
-const forwarder = new SerialForwarder();
+import { useStore } from '../services/store';
+
+// A forwarder per serial channel of the sandbox
+const forwarders = new Map<string, SerialForwarder>();
+const forwarderFor = (channel: string) => {
+  let forwarder = forwarders.get(channel);
+  if (!forwarder) {
+    forwarder = new SerialForwarder(channel);
+    forwarders.set(channel, forwarder);
+  }
+  return forwarder;
+};
 const remoteDesktop = new RemoteDesktop();
 
 enum ControlState {
@@ -17,10 +29,26 @@ enum ControlState {
 }
 
 export const Viewer = () => {
+  const { hostname } = qs.parse(location.search) as Record<string, string | undefined>;
   const [state, setState] = useState<State>(State.Disconnected);
   const [control, setControl] = useState(ControlState.ControlAndSerial);
   const [client, setClient] = useState<Guacamole.Client | undefined>(undefined);
   const [buttonText, setButtonText] = useState('Connect');
+  // Credentials for admin connections, sandboxes need none
+  const [username, setUsername] = useState('');
+  const [password, setPassword] = useState('');
+  const watched = useStore((state) => state.session?.watched);
+  const serialChannels = useStore((state) => state.session?.serialChannels) || [DEFAULT_CHANNEL];
+  const fileTransfer = useStore((state) => state.session?.fileTransfer);
+  const waiting = useStore((state) => state.session?.waiting);
+  const queuePosition = useStore((state) => state.session?.queuePosition);
+
+  // Check often while waiting so the group can connect once a sandbox is assigned
+  useEffect(() => {
+    if (!waiting) return;
+    const interval = setInterval(() => useStore.getState().validateSession(), 3000);
+    return () => clearInterval(interval);
+  }, [waiting]);
 
   useEffect(() => {
     if (state === State.Ready) return;
@@ -52,7 +80,7 @@ export const Viewer = () => {
   useEffect(() => {
     function reset() {
       remoteDesktop.disconnect();
-      forwarder.disconnect();
+      forwarders.forEach((forwarder) => forwarder.disconnect());
       setState(State.Disconnected);
     }
 
@@ -72,16 +100,20 @@ export const Viewer = () => {
     // Set listeners
     remoteDesktop.addListener('connect', onRemoteDesktopConnect);
     remoteDesktop.addListener('disconnect', onRemoteDesktopDisconnect);
-    forwarder.addListener('connect', onForwarderConnect);
-    forwarder.addListener('disconnect', onForwarderDisconnect);
+    serialChannels.map(forwarderFor).forEach((forwarder) => {
+      forwarder.addListener('connect', onForwarderConnect);
+      forwarder.addListener('disconnect', onForwarderDisconnect);
+    });
 
     return () => {
       remoteDesktop.removeListener('connect', onRemoteDesktopConnect);
       remoteDesktop.removeListener('disconnect', onRemoteDesktopDisconnect);
-      forwarder.removeListener('connect', onForwarderConnect);
-      forwarder.removeListener('disconnect', onForwarderDisconnect);
+      serialChannels.map(forwarderFor).forEach((forwarder) => {
+        forwarder.removeListener('connect', onForwarderConnect);
+        forwarder.removeListener('disconnect', onForwarderDisconnect);
+      });
     };
-  }, []);
+  }, [serialChannels.join()]);
 
   async function onConnectClick(e: any) {
     setState(State.Connecting);
@@ -93,16 +125,34 @@ export const Viewer = () => {
     // const forwarder = new SerialForwarder();
     // TODO: Add event listeners
     if (control === ControlState.ControlAndSerial) {
-      await forwarder.connect();
+      // Every channel asks for its own serial port
+      for (const channel of serialChannels) {
+        await forwarderFor(channel).connect();
+      }
     }
 
-    // Opts from query
-    const opts = qs.parse(location.search);
-    console.log(`Connecting with opts`, opts);
-
-    // Initialize Guacamole Client
-    // const rd = new RemoteDesktop();
-    await remoteDesktop.connect(opts);
+    // Opts from query, credentials are entered in the form so they stay out of urls
+    const { shadow, protocol, port, ignorecert, security } = qs.parse(location.search) as Record<string, string | undefined>;
+
+    // Initialize Guacamole Client, admins can shadow a group's desktop or
+    // open a connection they requested
+    if (shadow) {
+      await remoteDesktop.connect({}, `/api/admin/sessions/${shadow}/shadow`);
+    } else if (hostname) {
+      console.log(`Requesting connection to ${hostname}`);
+      const token = await requestConnection({
+        hostname,
+        protocol: protocol as any,
+        port: port ? Number(port) : undefined,
+        username: username || undefined,
+        password: password || undefined,
+        ignorecert: ignorecert === 'true',
+        security: security as any,
+      });
+      await remoteDesktop.connect({ token });
+    } else {
+      await remoteDesktop.connect();
+    }
 
     // Set references
 
@@ -116,7 +166,46 @@ export const Viewer = () => {
 
   return (
     <div className='overflow-hidden'>
-      {state !== State.Disconnected ? null : <ConnectButton state={state} onClick={onConnectClick} text={buttonText} />}
+      {watched ? (
+        <div className='fixed top-0 inset-x-0 z-50 p-1 text-center text-sm text-white bg-red-600'>
+          An instructor is currently viewing your screen
+        </div>
+      ) : null}
+      {waiting && state === State.Disconnected ? (
+        <div className='absolute left-1/2 -translate-x-1/2 px-6 py-3 rounded-b-md bg-yellow-500 text-white font-bold'>
+          {queuePosition ? `Waiting for a sandbox, you are number ${queuePosition} in line` : 'Waiting for your sandbox...'}
+        </div>
+      ) : null}
+      {state !== State.Disconnected || waiting ? null : <ConnectButton state={state} onClick={onConnectClick} text={buttonText} />}
+      {state === State.Disconnected && hostname ? (
+        <form className='absolute top-16 left-1/2 -translate-x-1/2 flex flex-col gap-2 p-4 bg-white shadow' onSubmit={(e: any) => e.preventDefault()}>
+          <p className='text-gray-500 text-sm'>Credentials for {hostname}, leave empty for sandboxes</p>
+          <input
+            className='p-2 border focus:outline-none'
+            type='text'
+            placeholder='Username'
+            autoComplete='username'
+            value={username}
+            onChange={(e: any) => setUsername(e.target.value)}
+          />
+          <input
+            className='p-2 border focus:outline-none'
+            type='password'
+            placeholder='Password'
+            autoComplete='current-password'
+            value={password}
+            onChange={(e: any) => setPassword(e.target.value)}
+          />
+        </form>
+      ) : null}
+      {state === State.Ready && control === ControlState.ControlAndSerial ? (
+        <div className='fixed top-0 right-4 z-40 flex gap-2'>
+          {serialChannels.map((channel) => (
+            <UploadButton forwarder={forwarderFor(channel)} />
+          ))}
+          {fileTransfer ? <TransferButton /> : null}
+        </div>
+      ) : null}
       <Display client={client} withControl={control !== ControlState.ViewOnly} />
     </div>
   );
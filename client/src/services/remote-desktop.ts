@@ -8,13 +8,30 @@ enum State {
 }
 
 export interface ConnectOpts {
-  protocol: 'vnc' | 'rdp';
+  protocol: 'vnc' | 'rdp' | 'ssh';
   hostname: string;
-  port: string;
+  port: number;
   username: string;
   password: string;
-  ignorecert: string;
-  security: 'any';
+  ignorecert: boolean;
+  security: 'any' | 'nla' | 'nla-ext' | 'tls' | 'vmconnect' | 'rdp';
+}
+
+/**
+ * Validates a connection of an admin, the returned token opens it once
+ * @returns connection token
+ */
+export async function requestConnection(opts: Partial<ConnectOpts>): Promise<string> {
+  const res = await fetch('/api/admin/connections', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(opts),
+  });
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.message);
+  }
+  return body.token;
 }
 
 export class RemoteDesktop extends EventEmitter {
@@ -49,9 +66,9 @@ export class RemoteDesktop extends EventEmitter {
     console.log('[RemoteDesktop] tunnel state: ', state);
   }
 
-  async connect(opts: Partial<ConnectOpts> = {}) {
+  async connect(params: Record<string, string> = {}, path = '/api/ws/guacamole') {
     const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const tunnel = new WebSocketTunnel(`${protocol}//${location.host}/api/ws/guacamole`);
+    const tunnel = new WebSocketTunnel(`${protocol}//${location.host}${path}`);
     const client = new Client(tunnel);
 
     // Set
@@ -64,7 +81,7 @@ export class RemoteDesktop extends EventEmitter {
     client.onerror = this.onClientError.bind(this);
     client.onstatechange = this.onClientStateChange.bind(this);
 
-    client.connect(qs.stringify(opts));
+    client.connect(qs.stringify(params));
 
     return () => {
       client.disconnect();
@@ -7,9 +7,51 @@ enum State {
   Ready,
 }
 
-/*
-  TODO: try and recover websocket disconnections to avoid having to request a SerialPort again
-*/
+// Framed serial protocol, see internal/serialbroker/frame.go
+const SUBPROTOCOL_FRAMED = 'remoto.serial.v2';
+// Unframed serial data as binary messages, for brokers without the framed protocol
+const SUBPROTOCOL_BINARY = 'remoto.serial.binary';
+enum FrameType {
+  Data = 0x00,
+  Control = 0x01,
+  Ack = 0x04,
+  File = 0x05,
+}
+// Minimum time between acks sent to the broker
+const ACK_INTERVAL = 100;
+// Frames kept until the broker acknowledges them
+const UNACKED_SIZE = 1024;
+// Channel of sandboxes with a single serial port
+export const DEFAULT_CHANNEL = 'default';
+
+interface Control {
+  type: 'line' | 'signals' | 'break';
+  baudRate?: number;
+  dataBits?: number;
+  stopBits?: number;
+  parity?: ParityType;
+  dtr?: boolean;
+  rts?: boolean;
+  duration?: number;
+}
+
+// Progress of a file upload, see internal/serialbroker/file.go
+export interface FileEvent {
+  type: 'progress' | 'done' | 'error';
+  name?: string;
+  size?: number;
+  written?: number;
+  path?: string;
+  error?: string;
+}
+
+const encodeFrame = (type: FrameType, seq: number, payload: Uint8Array) => {
+  const frame = new Uint8Array(payload.length + 5);
+  frame[0] = type;
+  new DataView(frame.buffer).setUint32(1, seq);
+  frame.set(payload, 5);
+  return frame;
+};
 
 export class SerialForwarder extends EventEmitter {
   protected aws?: AutoWebSocket;
@@ -18,6 +60,24 @@ export class SerialForwarder extends EventEmitter {
   protected serialRead?: ReadableStreamDefaultReader<Uint8Array>;
   protected serialWrite?: WritableStreamDefaultWriter<Uint8Array>;
   protected readLoopAlive = false;
+  // Incremented when the port is reopened, stopping the previous read loop
+  protected readLoopID = 0;
+  protected framed = false;
+  protected serialOptions: SerialOptions = { baudRate: 115200 };
+  // Set once a framed websocket connected, reconnects then resume the tunnel
+  protected resumable = false;
+  // Sequence number of the last frame sent and the frames the broker did not acknowledge
+  protected outSeq = 0;
+  protected unacked: { seq: number; frame: Uint8Array }[] = [];
+  // Sequence number of the last frame received from the broker
+  protected inSeq = 0;
+  protected ackTimer?: number;
+  // Frames are resent after the first ack of a new websocket
+  protected resend = false;
+
+  constructor(readonly channel = DEFAULT_CHANNEL) {
+    super();
+  }
 
   async connect() {
     await this.connectWebsocket();
@@ -44,9 +104,22 @@ export class SerialForwarder extends EventEmitter {
   protected async connectWebsocket() {
     const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
     const q = qs.parse(location.search) as any;
-    const ws = new WebSocket(`${protocol}//${location.host}/api/ws/serial?` + qs.stringify(q));
+    if (this.channel !== DEFAULT_CHANNEL) {
+      q.channel = this.channel;
+    }
+    if (this.resumable) {
+      q.resume = this.inSeq;
+    }
+    const ws = new WebSocket(`${protocol}//${location.host}/api/ws/serial?` + qs.stringify(q), [
+      SUBPROTOCOL_FRAMED,
+      SUBPROTOCOL_BINARY,
+    ]);
+    ws.binaryType = 'arraybuffer';
     ws.onopen = () => {
-      console.log('[SerialForwarder] Websocket connected');
+      this.framed = ws.protocol === SUBPROTOCOL_FRAMED;
+      this.resumable = this.framed;
+      this.resend = true;
+      console.log('[SerialForwarder] Websocket connected, protocol:', ws.protocol || 'text');
       this.ws = ws;
       ws.onmessage = this.onWebsocketData.bind(this);
     };
@@ -62,8 +135,9 @@ export class SerialForwarder extends EventEmitter {
     let port: SerialPort;
 
     try {
+      // Other channels forward other devices, such as a debug probe
       port = await navigator.serial.requestPort({
-        filters: [{ usbVendorId: 0x2e8a, usbProductId: 0x0005 }],
+        filters: this.channel === DEFAULT_CHANNEL ? [{ usbVendorId: 0x2e8a, usbProductId: 0x0005 }] : [],
       });
     } catch (e) {
       alert('Could not open serial port. Page will be refreshed');
@@ -82,7 +156,7 @@ export class SerialForwarder extends EventEmitter {
 
     // Open the serial port
     try {
-      await port.open({ baudRate: 115200 });
+      await port.open(this.serialOptions);
       console.log('[SerialForwarder] Serial port opened');
     } catch (e) {
       alert('Could not open serial port. Page will be refreshed');
@@ -103,21 +177,166 @@ export class SerialForwarder extends EventEmitter {
   }
 
   private encoder = new TextEncoder();
-  async onWebsocketData(ev: MessageEvent<string>) {
+  private decoder = new TextDecoder();
+  async onWebsocketData(ev: MessageEvent<string | ArrayBuffer>) {
+    if (this.framed && typeof ev.data !== 'string' && new Uint8Array(ev.data)[0] === FrameType.Ack) {
+      this.onAck(new DataView(ev.data).getUint32(1));
+      return;
+    }
+
     if (!this.serialWrite || !this.ws) {
       console.log("[SerialForwarder] onWebSocketData: Can't pipe without a serial port and websocket");
       return;
     }
 
-    // Pipe WS to Serial
-    this.serialWrite.write(this.encoder.encode(ev.data));
+    // Unframed brokers send text messages, or binary messages if negotiated
+    if (typeof ev.data === 'string') {
+      this.serialWrite.write(this.encoder.encode(ev.data));
+      return;
+    }
+    if (!this.framed) {
+      this.serialWrite.write(new Uint8Array(ev.data));
+      return;
+    }
+
+    const frame = new Uint8Array(ev.data);
+    const seq = new DataView(ev.data).getUint32(1);
+    const payload = frame.subarray(5);
+
+    // Resent after a reconnect
+    if (seq <= this.inSeq) return;
+    this.inSeq = seq;
+    this.scheduleAck();
+
+    switch (frame[0]) {
+      case FrameType.Data:
+        this.serialWrite.write(payload);
+        break;
+      case FrameType.Control:
+        this.onControl(JSON.parse(this.decoder.decode(payload)));
+        break;
+      case FrameType.File:
+        this.emit('file', JSON.parse(this.decoder.decode(payload)) as FileEvent);
+        break;
+    }
+  }
+
+  /**
+   * Uploads a file to the sandbox through the agent of this channel, progress
+   * is emitted as file events
+   */
+  async upload(file: File) {
+    const q: Record<string, string> = { name: file.name };
+    if (this.channel !== DEFAULT_CHANNEL) {
+      q.channel = this.channel;
+    }
+    const res = await fetch('/api/serial/files?' + qs.stringify(q), { method: 'POST', body: file });
+    const body = await res.json();
+    if (!res.ok) {
+      throw new Error(body.message);
+    }
+    return body as { name: string; path: string; size: number };
+  }
+
+  /**
+   * Drops the frames the broker received, and resends the others after reconnecting
+   */
+  protected onAck(seq: number) {
+    this.unacked = this.unacked.filter((f) => f.seq > seq);
+    if (!this.resend) return;
+    this.resend = false;
+    this.unacked.forEach((f) => this.ws?.send(f.frame));
   }
 
-  async pipeSerialToWS() {
+  protected scheduleAck() {
+    if (this.ackTimer) return;
+    this.ackTimer = window.setTimeout(() => {
+      this.ackTimer = undefined;
+      this.ws?.send(encodeFrame(FrameType.Ack, this.inSeq, new Uint8Array()));
+    }, ACK_INTERVAL);
+  }
+
+  /**
+   * Sends serial data, framed data is kept until acknowledged so it survives a reconnect
+   */
+  protected send(value: Uint8Array) {
+    if (!this.resumable) {
+      this.ws?.send(value);
+      return;
+    }
+
+    const seq = ++this.outSeq;
+    const frame = encodeFrame(FrameType.Data, seq, value);
+    this.unacked.push({ seq, frame });
+    if (this.unacked.length > UNACKED_SIZE) {
+      this.unacked.shift();
+    }
+    // Sent after the first ack of a new websocket
+    if (!this.resend) {
+      this.ws?.send(frame);
+    }
+  }
+
+  /**
+   * Applies a control frame of the sandbox to the serial port
+   */
+  async onControl(control: Control) {
+    const port = this.serialPort;
+    if (!port) return;
+    console.log('[SerialForwarder] Control', control);
+
+    switch (control.type) {
+      case 'line':
+        this.serialOptions = {
+          baudRate: control.baudRate || this.serialOptions.baudRate,
+          dataBits: control.dataBits || this.serialOptions.dataBits,
+          stopBits: control.stopBits || this.serialOptions.stopBits,
+          parity: control.parity || this.serialOptions.parity,
+        };
+        await this.reopenSerialPort(port);
+        break;
+      case 'signals':
+        await port.setSignals({ dataTerminalReady: control.dtr, requestToSend: control.rts });
+        break;
+      case 'break':
+        await port.setSignals({ break: true });
+        setTimeout(() => port.setSignals({ break: false }), control.duration || 250);
+        break;
+    }
+  }
+
+  /**
+   * Line settings can only be changed by reopening the port
+   */
+  protected async reopenSerialPort(port: SerialPort) {
+    this.readLoopAlive = false;
+    this.readLoopID++;
+    await this.serialRead?.cancel();
+    this.serialRead?.releaseLock();
+    this.serialWrite?.releaseLock();
+    this.serialRead = undefined;
+    this.serialWrite = undefined;
+
+    await port.close();
+    await port.open(this.serialOptions);
+    if (!port.readable || !port.writable) {
+      throw new Error("Can't open port with correct permissions");
+    }
+
+    this.serialRead = port.readable.getReader();
+    this.serialWrite = port.writable.getWriter();
+    this.readLoopAlive = true;
+    this.pipeSerialToWS();
+  }
+
+  async pipeSerialToWS(loopID = this.readLoopID) {
+    if (loopID !== this.readLoopID) return;
+
     console.log('[SerialForwarder] Reading serial port...');
-    if (!this.serialRead || !this.ws) {
+    // Framed data is kept while reconnecting
+    if (!this.serialRead || (!this.ws && !this.resumable)) {
       console.log("[SerialForwarder] pipeSerialToWS: Can't pipe without a serial port and websocket");
-      this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this), 1000);
+      this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this, loopID), 1000);
       return;
     }
 
@@ -131,13 +350,13 @@ export class SerialForwarder extends EventEmitter {
     // Skip empty data
     if (value === undefined) {
       console.log('[SerialForwarder] Skipping empty data');
-      this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this), 5);
+      this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this, loopID), 5);
       return;
     }
 
-    this.ws.send(value);
+    this.send(value);
 
     // Continue
-    this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this), 5);
+    this.readLoopAlive && setTimeout(this.pipeSerialToWS.bind(this, loopID), 5);
   }
 }
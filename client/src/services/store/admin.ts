@@ -4,18 +4,23 @@ interface AdminState {
   selectedSession: Session | null;
   selectedSandbox: Sandbox | null;
   adminSummary: AdminData | null | undefined;
+  recordings: Recording[];
 
   fetchAdminSummary(): void;
+  fetchRecordings(): void;
+  subscribeAdminEvents(): () => void;
   selectSession(session: Session | null): void;
   selectSandbox(sandbox: Sandbox | null): void;
   destroySession(sessionID: string): void;
   assignSandbox(sessionID: string, sandboxIP: string): void;
+  pushHandout(file: File, workshopID?: string): Promise<HandoutResult>;
 }
 
 export const adminSlice: StateCreator<AdminState> = (set, get) => ({
   selectedSandbox: null,
   selectedSession: null,
   adminSummary: undefined,
+  recordings: [],
 
   /**
    *
@@ -31,6 +36,47 @@ export const adminSlice: StateCreator<AdminState> = (set, get) => ({
     set({ adminSummary: admin });
   },
 
+  /**
+   * Lists the session recordings, the list is empty if recording is disabled
+   */
+  async fetchRecordings() {
+    const res = await fetch('/api/admin/recordings');
+
+    if (!res.ok) {
+      set({ recordings: [] });
+      return;
+    }
+
+    set({ recordings: await res.json() });
+  },
+
+  /**
+   * Receives a snapshot and then live updates of the admin summary
+   * @returns function to unsubscribe
+   */
+  subscribeAdminEvents() {
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    let ws: WebSocket;
+    let closed = false;
+
+    const connect = () => {
+      ws = new WebSocket(`${protocol}//${location.host}/api/admin/events`);
+      ws.onmessage = (msg) => {
+        const event: AdminEvent = JSON.parse(msg.data);
+        set({ adminSummary: applyAdminEvent(get().adminSummary, event) });
+      };
+      ws.onclose = () => {
+        if (!closed) setTimeout(connect, 2000);
+      };
+    };
+    connect();
+
+    return () => {
+      closed = true;
+      ws.close();
+    };
+  },
+
   /**
    *
    * @param session
@@ -81,4 +127,72 @@ export const adminSlice: StateCreator<AdminState> = (set, get) => ({
 
     return get().fetchAdminSummary();
   },
+
+  /**
+   * Copies a file to the transfer directory of every group the admin administers
+   */
+  async pushHandout(file, workshopID) {
+    const query = new URLSearchParams({ name: file.name });
+    if (workshopID) query.set('workshop', workshopID);
+    const res = await fetch('/api/admin/handouts?' + query.toString(), {
+      method: 'POST',
+      body: file,
+    });
+
+    const body = await res.json();
+    if (!res.ok) {
+      throw new Error(body.message);
+    }
+    return body;
+  },
 });
+
+const sameSandbox = (a: Sandbox, b: Sandbox) => a.ip === b.ip && a.workshopID === b.workshopID;
+
+/**
+ * Applies an admin event to the summary
+ */
+const applyAdminEvent = (summary: AdminData | null | undefined, event: AdminEvent): AdminData | null | undefined => {
+  if (event.type === 'snapshot') {
+    return event.data;
+  }
+  if (!summary) {
+    return summary;
+  }
+
+  const sessions = summary.sessions.slice();
+  const sandboxes = summary.sandboxes.slice();
+
+  switch (event.type) {
+    case 'session.created':
+    case 'session.updated':
+    case 'session.touched': {
+      const ix = sessions.findIndex((s) => s.id === event.data.id);
+      ix === -1 ? sessions.push(event.data) : (sessions[ix] = event.data);
+      break;
+    }
+    case 'session.deleted':
+      return { ...summary, sessions: sessions.filter((s) => s.id !== event.data.id), sandboxes };
+    case 'sandbox.discovered':
+    case 'sandbox.reserved':
+    case 'sandbox.released':
+    case 'sandbox.health': {
+      const ix = sandboxes.findIndex((s) => sameSandbox(s, event.data));
+      ix === -1 ? sandboxes.push(event.data) : (sandboxes[ix] = event.data);
+      break;
+    }
+    case 'sandbox.agent': {
+      const ix = sandboxes.findIndex((s) => sameSandbox(s, event.data));
+      if (ix === -1) break;
+      const agents = (sandboxes[ix].agents || []).filter((a) => a.channel !== event.data.agent.channel);
+      agents.push(event.data.agent);
+      agents.sort((a, b) => a.channel.localeCompare(b.channel));
+      sandboxes[ix] = { ...sandboxes[ix], agents };
+      break;
+    }
+    case 'sandbox.lost':
+      return { ...summary, sessions, sandboxes: sandboxes.filter((s) => !sameSandbox(s, event.data)) };
+  }
+
+  return { ...summary, sessions, sandboxes };
+};
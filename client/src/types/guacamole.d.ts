@@ -711,6 +711,62 @@ declare module 'guacamole-common-js' {
    * handling a provided Guacamole.InputStream. Data received along the provided
    * stream is to be played back immediately.
    */
+  /**
+   * A recording of a Guacamole session. Given a Guacamole.Tunnel, the
+   * Guacamole.SessionRecording automatically handles incoming Guacamole
+   * instructions, storing them for playback.
+   */
+  class SessionRecording {
+    /**
+     * @param {Guacamole.Tunnel} tunnel
+     *     The Guacamole.Tunnel from which the instructions of the recording
+     *     should be read.
+     */
+    constructor(tunnel: Tunnel);
+
+    /**
+     * Fired when new frames have become available while the recording is
+     * being downloaded.
+     */
+    onprogress: null | ((duration: number) => void);
+
+    /** Fired whenever playback of the recording has started. */
+    onplay: null | (() => void);
+
+    /** Fired whenever playback of the recording has been paused. */
+    onpause: null | (() => void);
+
+    /** Fired whenever the playback position within the recording changes. */
+    onseek: null | ((position: number) => void);
+
+    /** Connects the underlying tunnel, beginning download of the recording. */
+    connect(data?: string): void;
+
+    /** Disconnects the underlying tunnel, stopping further download. */
+    disconnect(): void;
+
+    /** Returns the display of the underlying Guacamole.Client. */
+    getDisplay(): Display;
+
+    /** Returns whether the recording is currently playing. */
+    isPlaying(): boolean;
+
+    /** Returns the current playback position within the recording, in milliseconds. */
+    getPosition(): number;
+
+    /** Returns the duration of the recording, in milliseconds. */
+    getDuration(): number;
+
+    /** Begins continuous playback of the recording. */
+    play(): void;
+
+    /** Seeks to the given position within the recording, in milliseconds. */
+    seek(position: number, callback?: () => void): void;
+
+    /** Pauses playback of the recording. */
+    pause(): void;
+  }
+
   class AudioPlayer {
     sync(): void;
     /**
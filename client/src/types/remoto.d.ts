@@ -1,24 +1,106 @@
 declare global {
   export interface SessionData {
+    workshopID?: string;
     groupName: string;
     isAdmin: boolean;
+    queuePosition?: number;
+    waiting?: boolean;
+    watched?: boolean;
+    serialChannels?: string[];
+    fileTransfer?: boolean;
   }
 
   export interface Session {
     id: string;
     groupName: string;
+    workshopID: string;
     sandboxIP: string;
+    queuePosition?: number;
+    tunnelActive?: boolean;
+    watchers?: number;
     lastActive: number;
+    serial?: SerialStats[];
+  }
+
+  export interface SerialStats {
+    channel: string;
+    agentConnected: boolean;
+    browserConnected: boolean;
+    deviceBytes: number;
+    sandboxBytes: number;
+    buffered: number;
   }
 
   export interface Sandbox {
     ip: string;
+    workshopID: string;
+    sessionID: string;
+    health: 'unknown' | 'healthy' | 'unhealthy';
+    lastError?: string;
+    lastChecked?: number;
+    agents?: AgentStatus[];
+  }
+
+  export interface AgentStatus {
+    channel: string;
+    connected: boolean;
+    client?: string;
+    deviceBytes: number;
+    sandboxBytes: number;
+    buffered: number;
+    lastActivity?: number;
+    reportedAt: number;
+  }
+
+  export interface Recording {
+    id: string;
+    workshopID: string;
     sessionID: string;
+    groupName: string;
+    startedAt: number;
+    endedAt?: number;
+    size: number;
+  }
+
+  export interface TransferFile {
+    name: string;
+    size: number;
+    modTime: number;
+  }
+
+  export interface TransferList {
+    files: TransferFile[];
+    usage: number;
+    quota: number;
+  }
+
+  export interface HandoutResult {
+    name: string;
+    size: number;
+    delivered: string[];
+    failed: Record<string, string>;
   }
 
   export interface AdminData {
     sessions: Session[];
     sandboxes: Sandbox[];
+    guacds?: Guacd[];
+  }
+
+  export interface Guacd {
+    addr: string;
+    active: number;
+    connections: number;
+    health: 'unknown' | 'healthy' | 'unhealthy';
+    lastError?: string;
+    lastFailure?: number;
+  }
+
+  export interface AdminEvent {
+    type: string;
+    time: number;
+    workshopID?: string;
+    data: any;
   }
 }
 
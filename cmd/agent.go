@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"remoto.senwize.com/internal/agent"
+	"remoto.senwize.com/internal/sandbox"
+)
+
+func agentCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Start the serial agent in a sandbox",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bufferSize, _ := strconv.Atoi(env("REMOTO_AGENT_BUFFER_SIZE", "0"))
+
+			a, err := agent.New(agent.Config{
+				Channel:    env("REMOTO_AGENT_CHANNEL", sandbox.DEFAULT_SERIAL_CHANNEL),
+				Addr:       env("REMOTO_AGENT_ADDR", ":5000"),
+				Link:       env("REMOTO_AGENT_LINK", "/dev/picolink"),
+				Token:      env("REMOTO_AGENT_TOKEN", ""),
+				StatusURL:  env("REMOTO_AGENT_STATUS_URL", ""),
+				BufferSize: bufferSize,
+				UploadDir:  env("REMOTO_AGENT_UPLOAD_DIR", ""),
+			})
+			if err != nil {
+				return err
+			}
+
+			return a.Run()
+		},
+	}
+
+	return cmd
+}
@@ -2,9 +2,13 @@ package cmd
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"remoto.senwize.com/internal/application"
+	"remoto.senwize.com/internal/workshop"
 )
 
 var rootCommand = &cobra.Command{
@@ -19,6 +23,7 @@ func Execute() {
 func init() {
 	rootCommand.AddCommand(
 		serveCommand(),
+		agentCommand(),
 	)
 }
 
@@ -28,12 +33,40 @@ func serveCommand() *cobra.Command {
 		Short: "Start the server",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg := loadConfig()
-			app := application.New(application.Config{
-				GuacdFQDN:    cfg.GuacdFQDN,
-				SandboxFQDN:  cfg.SandboxFQDN,
-				WorkshopCode: cfg.WorkshopCode,
-				AdminCode:    cfg.AdminCode,
+			workshops, err := loadWorkshops(cfg)
+			if err != nil {
+				return err
+			}
+
+			app, err := application.New(application.Config{
+				GuacdSource:   cfg.GuacdSource,
+				GuacdStrategy: application.GuacdStrategy(cfg.GuacdStrategy),
+
+				ConnectionNetworks:  cfg.ConnectionNetworks,
+				ConnectionProtocols: cfg.ConnectionProtocols,
+
+				Workshops:      workshops,
+				AdminCode:      cfg.AdminCode,
+				StateDir:       cfg.StateDir,
+				IdleTimeout:    cfg.IdleTimeout,
+				SessionTimeout: cfg.SessionTimeout,
+				ReclaimGrace:   cfg.ReclaimGrace,
+				RecordingsDir:  cfg.RecordingsDir,
+
+				TransferDir:      cfg.TransferDir,
+				GuacdTransferDir: cfg.GuacdTransferDir,
+				TransferQuota:    int64(cfg.TransferQuota),
+				TransferGID:      cfg.TransferGID,
+
+				SerialTranscriptDir:  cfg.SerialTranscriptDir,
+				SerialGracePeriod:    cfg.SerialGracePeriod,
+				SerialBufferSize:     cfg.SerialBufferSize,
+				SerialReadBufferSize: cfg.SerialReadBufferSize,
+				AgentToken:           cfg.AgentToken,
 			})
+			if err != nil {
+				return err
+			}
 
 			app.Serve(cfg.HTTPAddr)
 
@@ -46,11 +79,33 @@ func serveCommand() *cobra.Command {
 
 // config ...
 type config struct {
-	GuacdFQDN    string
-	SandboxFQDN  string
-	HTTPAddr     string
-	WorkshopCode string
-	AdminCode    string
+	GuacdSource   string
+	GuacdStrategy string
+
+	ConnectionNetworks  []string
+	ConnectionProtocols []string
+	SandboxSource       string
+	HTTPAddr            string
+	WorkshopCode        string
+	AdminCode           string
+	StateDir            string
+	WorkshopsFile       string
+	RecordingsDir       string
+
+	TransferDir      string
+	GuacdTransferDir string
+	TransferQuota    int
+	TransferGID      int
+
+	SerialTranscriptDir  string
+	SerialGracePeriod    time.Duration
+	SerialBufferSize     int
+	SerialReadBufferSize int
+	AgentToken           string
+
+	IdleTimeout    time.Duration
+	SessionTimeout time.Duration
+	ReclaimGrace   time.Duration
 }
 
 func env(key, defaultValue string) string {
@@ -60,12 +115,83 @@ func env(key, defaultValue string) string {
 	return defaultValue
 }
 
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+func envInt(key string, defaultValue int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	return i
+}
+
+// envList splits a comma separated variable, empty items are dropped
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(env(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func loadConfig() *config {
 	return &config{
-		GuacdFQDN:    env("REMOTO_GUACD_FQDN", "guacd.remoto.local"),
-		SandboxFQDN:  env("REMOTO_SANDBOX_FQDN", "sandbox.remoto.local"),
-		HTTPAddr:     env("REMOTO_HTTP_ADDR", ":3000"),
-		WorkshopCode: env("REMOTO_WORKSHOP_CODE", "demo"),
-		AdminCode:    env("REMOTO_ADMIN_CODE", "admin"),
+		GuacdSource:   env("REMOTO_GUACD_DISCOVERY", env("REMOTO_GUACD_FQDN", "guacd.remoto.local")),
+		GuacdStrategy: env("REMOTO_GUACD_STRATEGY", ""),
+
+		ConnectionNetworks:  envList("REMOTO_CONNECTION_NETWORKS"),
+		ConnectionProtocols: envList("REMOTO_CONNECTION_PROTOCOLS"),
+		SandboxSource:       env("REMOTO_SANDBOX_DISCOVERY", env("REMOTO_SANDBOX_FQDN", "sandbox.remoto.local")),
+		HTTPAddr:            env("REMOTO_HTTP_ADDR", ":3000"),
+		WorkshopCode:        env("REMOTO_WORKSHOP_CODE", "demo"),
+		AdminCode:           env("REMOTO_ADMIN_CODE", "admin"),
+		StateDir:            env("REMOTO_STATE_DIR", ""),
+		WorkshopsFile:       env("REMOTO_WORKSHOPS_FILE", ""),
+		RecordingsDir:       env("REMOTO_RECORDINGS_DIR", ""),
+
+		TransferDir:      env("REMOTO_TRANSFER_DIR", ""),
+		GuacdTransferDir: env("REMOTO_GUACD_TRANSFER_DIR", ""),
+		TransferQuota:    envInt("REMOTO_TRANSFER_QUOTA", 0),
+		TransferGID:      envInt("REMOTO_TRANSFER_GID", -1),
+
+		SerialTranscriptDir:  env("REMOTO_SERIAL_TRANSCRIPT_DIR", ""),
+		SerialGracePeriod:    envDuration("REMOTO_SERIAL_GRACE_PERIOD", 0),
+		SerialBufferSize:     envInt("REMOTO_SERIAL_BUFFER_SIZE", 0),
+		SerialReadBufferSize: envInt("REMOTO_SERIAL_READ_BUFFER_SIZE", 0),
+		AgentToken:           env("REMOTO_AGENT_TOKEN", ""),
+
+		IdleTimeout:    envDuration("REMOTO_SESSION_IDLE_TIMEOUT", 0),
+		SessionTimeout: envDuration("REMOTO_SESSION_TIMEOUT", 0),
+		ReclaimGrace:   envDuration("REMOTO_SANDBOX_RECLAIM_GRACE", 0),
 	}
 }
+
+// loadWorkshops reads the workshops file, or creates a single workshop from
+// the workshop code and sandbox discovery settings
+func loadWorkshops(cfg *config) ([]workshop.Workshop, error) {
+	if cfg.WorkshopsFile != "" {
+		return workshop.Load(cfg.WorkshopsFile)
+	}
+
+	return []workshop.Workshop{{
+		ID:        "default",
+		Code:      cfg.WorkshopCode,
+		Sandboxes: cfg.SandboxSource,
+	}}, nil
+}
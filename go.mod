@@ -8,11 +8,11 @@ require (
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.3.0
 	github.com/wwt/guac v1.3.1
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
 )
 
 require (
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d // indirect
 )
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/serialbroker"
+)
+
+/*
+	The agent runs in the sandbox and replaces the socat picolink service:
+		- it creates a pty and links it at a fixed path, such as /dev/picolink
+		- it accepts authenticated broker connections speaking the framed protocol
+		- it buffers the output of the pty while no broker is connected
+		- it places files uploaded through the broker in the upload directory
+		- it reports its status to the control server
+*/
+
+var (
+	// Time allowed to write a frame to the broker
+	WRITE_TIMEOUT = 10 * time.Second
+	// Interval at which line settings of the pty are checked for changes
+	LINE_POLL_INTERVAL = 250 * time.Millisecond
+	// Bytes of pty output kept while no broker is connected if not configured
+	BUFFER_DEFAULT_SIZE = 64 * 1024
+)
+
+// Config ...
+type Config struct {
+	// Channel is the serial channel of the sandbox the agent serves
+	Channel string
+	// Addr is the address brokers connect to
+	Addr string
+	// Link is where the pty is linked, programs use it as the serial port
+	Link string
+	// Token authenticates brokers, it must match the control server
+	Token string
+	// StatusURL is the control server endpoint status is reported to, status
+	// is not reported if empty
+	StatusURL string
+	// BufferSize is the number of bytes of pty output kept while no broker is connected
+	BufferSize int
+	// UploadDir is where files uploaded by participants are placed, uploads
+	// are disabled if empty
+	UploadDir string
+}
+
+// Agent ...
+type Agent struct {
+	cfg Config
+	pty *pty
+
+	// clientLock guards the client, buffer and counters
+	clientLock   sync.Locker
+	client       net.Conn
+	buffer       *buffer
+	line         serialbroker.Control
+	deviceBytes  uint64
+	sandboxBytes uint64
+	lastActivity time.Time
+}
+
+func New(cfg Config) (*Agent, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("agent token is required")
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = sandbox.DEFAULT_SERIAL_CHANNEL
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = BUFFER_DEFAULT_SIZE
+	}
+
+	return &Agent{
+		cfg:        cfg,
+		clientLock: &sync.Mutex{},
+		buffer:     newBuffer(cfg.BufferSize),
+	}, nil
+}
+
+// Run serves brokers until the process is interrupted
+func (a *Agent) Run() error {
+	p, err := openPTY()
+	if err != nil {
+		return fmt.Errorf("could not open pty: %w", err)
+	}
+	defer p.Close()
+	a.pty = p
+
+	// Link the pty, like socat's link option
+	os.Remove(a.cfg.Link)
+	if err := os.Symlink(p.Name(), a.cfg.Link); err != nil {
+		return fmt.Errorf("could not link pty: %w", err)
+	}
+	defer os.Remove(a.cfg.Link)
+	if err := os.Chmod(p.Name(), 0o666); err != nil {
+		return fmt.Errorf("could not change pty permissions: %w", err)
+	}
+	log.Printf("[Agent] Linked pty %s at %s", p.Name(), a.cfg.Link)
+
+	listener, err := net.Listen("tcp", a.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("[Agent] Listening on %s", a.cfg.Addr)
+
+	errC := make(chan error, 1)
+	go a.readPTY(errC)
+	go a.acceptBrokers(listener, errC)
+	go a.pollLine()
+	if a.cfg.StatusURL != "" {
+		go a.reportStatus()
+	}
+
+	// Wait for exit
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errC:
+		return err
+	case <-sig:
+		log.Printf("[Agent] Shutting down")
+		return nil
+	}
+}
+
+// readPTY forwards the output of the pty to the broker, or buffers it while
+// no broker is connected
+func (a *Agent) readPTY(errC chan error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := a.pty.Read(buf)
+		if err != nil {
+			errC <- fmt.Errorf("reading pty: %w", err)
+			return
+		}
+
+		a.clientLock.Lock()
+		a.sandboxBytes += uint64(n)
+		a.lastActivity = time.Now()
+		if a.client == nil {
+			a.buffer.Write(buf[:n])
+		} else if rest := a.sendData(buf[:n]); len(rest) > 0 {
+			a.buffer.Write(rest)
+		}
+		a.clientLock.Unlock()
+	}
+}
+
+// send writes a frame to the broker, dropping the broker on failure. The
+// client lock must be held.
+func (a *Agent) send(f serialbroker.Frame) error {
+	a.client.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	err := serialbroker.WriteFrame(a.client, f)
+	if err != nil {
+		log.Printf("[Agent] Dropping broker %s: %v", a.client.RemoteAddr(), err)
+		a.client.Close()
+		a.client = nil
+	}
+	return err
+}
+
+// sendData writes data to the broker in frames of at most FRAME_MAX_PAYLOAD
+// bytes, it returns the data that was not sent. The client lock must be held.
+func (a *Agent) sendData(data []byte) []byte {
+	for len(data) > 0 {
+		n := len(data)
+		if n > serialbroker.FRAME_MAX_PAYLOAD {
+			n = serialbroker.FRAME_MAX_PAYLOAD
+		}
+		if a.send(serialbroker.DataFrame(data[:n])) != nil {
+			return data
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (a *Agent) acceptBrokers(listener net.Listener, errC chan error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errC <- err
+			return
+		}
+		go a.serveBroker(conn)
+	}
+}
+
+// serveBroker authenticates the broker and writes its data to the pty.
+// A new broker replaces the current one.
+func (a *Agent) serveBroker(conn net.Conn) {
+	defer conn.Close()
+
+	if err := a.authenticate(conn); err != nil {
+		// Health checks of the control server connect and close right away
+		if !errors.Is(err, io.EOF) {
+			log.Printf("[Agent] Rejected broker %s: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	a.clientLock.Lock()
+	if a.client != nil {
+		log.Printf("[Agent] Broker %s replaces %s", conn.RemoteAddr(), a.client.RemoteAddr())
+		a.client.Close()
+	}
+	a.client = conn
+	log.Printf("[Agent] Broker %s connected", conn.RemoteAddr())
+
+	// Bring the browser up to date
+	if a.line.Type != "" {
+		if f, err := serialbroker.ControlFrame(a.line); err == nil {
+			a.send(f)
+		}
+	}
+	if a.client != nil && a.buffer.Len() > 0 {
+		data, dropped := a.buffer.Take()
+		if dropped > 0 {
+			log.Printf("[Agent] Dropped %d bytes of output while no broker was connected", dropped)
+		}
+		if rest := a.sendData(data); len(rest) > 0 {
+			a.buffer.Write(rest)
+		}
+	}
+	a.clientLock.Unlock()
+
+	var up *upload
+	defer func() {
+		if up != nil {
+			up.abort()
+		}
+	}()
+
+	for {
+		f, err := serialbroker.ReadFrame(conn)
+		if err != nil {
+			break
+		}
+
+		switch f.Type {
+		case serialbroker.FrameData:
+			if _, err := a.pty.Write(f.Payload); err != nil {
+				log.Printf("[Agent] Writing pty: %v", err)
+			}
+			a.clientLock.Lock()
+			a.deviceBytes += uint64(len(f.Payload))
+			a.lastActivity = time.Now()
+			a.clientLock.Unlock()
+		case serialbroker.FrameControl:
+			// A pty has no line settings or modem signals to apply
+			if c, err := f.Control(); err == nil {
+				log.Printf("[Agent] Ignoring %s control frame", c.Type)
+			}
+		case serialbroker.FrameFile, serialbroker.FrameFileData:
+			up = a.onFile(conn, up, f)
+		}
+	}
+
+	a.clientLock.Lock()
+	if a.client == conn {
+		a.client = nil
+		log.Printf("[Agent] Broker %s disconnected", conn.RemoteAddr())
+	}
+	a.clientLock.Unlock()
+}
+
+// authenticate challenges the broker to prove it knows the token
+func (a *Agent) authenticate(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(serialbroker.HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := serialbroker.NewChallenge()
+	if err := serialbroker.WriteFrame(conn, serialbroker.Frame{Type: serialbroker.FrameHello, Payload: challenge}); err != nil {
+		return err
+	}
+
+	f, err := serialbroker.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if f.Type != serialbroker.FrameAuth || !serialbroker.VerifyAuth(a.cfg.Token, challenge, f.Payload) {
+		return serialbroker.ErrUnauthorized
+	}
+	return nil
+}
+
+// pollLine forwards changes of the line settings, such as the 1200 baud
+// touch that resets a Pico into its bootloader
+func (a *Agent) pollLine() {
+	ticker := time.NewTicker(LINE_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		line, err := a.pty.LineSettings()
+		if err != nil || line.Validate() != nil {
+			continue
+		}
+
+		a.clientLock.Lock()
+		if line != a.line {
+			a.line = line
+			log.Printf("[Agent] Line settings changed: %d baud, %d%s%d", line.BaudRate, line.DataBits, line.Parity[:1], line.StopBits)
+			if a.client != nil {
+				if f, err := serialbroker.ControlFrame(line); err == nil {
+					a.send(f)
+				}
+			}
+		}
+		a.clientLock.Unlock()
+	}
+}
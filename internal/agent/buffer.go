@@ -0,0 +1,32 @@
+package agent
+
+// buffer keeps the most recent output of the pty while no broker is
+// connected, the oldest bytes are dropped first
+type buffer struct {
+	data    []byte
+	limit   int
+	dropped int
+}
+
+func newBuffer(limit int) *buffer {
+	return &buffer{limit: limit}
+}
+
+func (b *buffer) Write(p []byte) {
+	b.data = append(b.data, p...)
+	if over := len(b.data) - b.limit; over > 0 {
+		b.dropped += over
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+}
+
+// Take empties the buffer, returning its contents and the number of bytes dropped
+func (b *buffer) Take() ([]byte, int) {
+	data, dropped := b.data, b.dropped
+	b.data, b.dropped = nil, 0
+	return data, dropped
+}
+
+func (b *buffer) Len() int {
+	return len(b.data)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"remoto.senwize.com/internal/serialbroker"
+)
+
+// pty is a pseudo terminal, programs in the sandbox use the slave side as if
+// it were the serial port of the device
+type pty struct {
+	master *os.File
+	// slave is kept open so reading the master does not fail while no
+	// program has the link open
+	slave *os.File
+}
+
+func openPTY() (*pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlock and find the slave
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("unlocking pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("finding pty slave: %w", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	p := &pty{master: master, slave: slave}
+	if err := p.makeRaw(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Name returns the path of the slave
+func (p *pty) Name() string {
+	return p.slave.Name()
+}
+
+func (p *pty) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+func (p *pty) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *pty) Close() error {
+	p.slave.Close()
+	return p.master.Close()
+}
+
+// makeRaw disables echo and line processing, like a real serial port
+func (p *pty) makeRaw() error {
+	fd := int(p.slave.Fd())
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.B115200
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+var baudRates = map[uint32]int{
+	unix.B50: 50, unix.B75: 75, unix.B110: 110, unix.B134: 134, unix.B150: 150,
+	unix.B200: 200, unix.B300: 300, unix.B600: 600, unix.B1200: 1200, unix.B1800: 1800,
+	unix.B2400: 2400, unix.B4800: 4800, unix.B9600: 9600, unix.B19200: 19200,
+	unix.B38400: 38400, unix.B57600: 57600, unix.B115200: 115200, unix.B230400: 230400,
+	unix.B460800: 460800, unix.B500000: 500000, unix.B576000: 576000, unix.B921600: 921600,
+	unix.B1000000: 1000000, unix.B1152000: 1152000, unix.B1500000: 1500000,
+	unix.B2000000: 2000000, unix.B2500000: 2500000, unix.B3000000: 3000000,
+	unix.B3500000: 3500000, unix.B4000000: 4000000,
+}
+
+var dataBits = map[uint32]int{
+	unix.CS5: 5, unix.CS6: 6, unix.CS7: 7, unix.CS8: 8,
+}
+
+// LineSettings returns the line settings programs in the sandbox configured
+// on the slave. Modem signals cannot be read from a pty.
+func (p *pty) LineSettings() (serialbroker.Control, error) {
+	t, err := unix.IoctlGetTermios(int(p.slave.Fd()), unix.TCGETS)
+	if err != nil {
+		return serialbroker.Control{}, err
+	}
+
+	line := serialbroker.Control{
+		Type:     serialbroker.ControlLine,
+		BaudRate: baudRates[t.Cflag&unix.CBAUD],
+		DataBits: dataBits[t.Cflag&unix.CSIZE],
+		StopBits: 1,
+		Parity:   "none",
+	}
+	if t.Cflag&unix.CSTOPB != 0 {
+		line.StopBits = 2
+	}
+	if t.Cflag&unix.PARENB != 0 {
+		line.Parity = "even"
+		if t.Cflag&unix.PARODD != 0 {
+			line.Parity = "odd"
+		}
+	}
+	return line, nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+
+	"remoto.senwize.com/internal/serialbroker"
+)
+
+var ErrUnsupported = errors.New("the agent only runs on linux")
+
+type pty struct{}
+
+func openPTY() (*pty, error) {
+	return nil, ErrUnsupported
+}
+
+func (p *pty) Name() string                { return "" }
+func (p *pty) Read(b []byte) (int, error)  { return 0, ErrUnsupported }
+func (p *pty) Write(b []byte) (int, error) { return 0, ErrUnsupported }
+func (p *pty) Close() error                { return nil }
+
+func (p *pty) LineSettings() (serialbroker.Control, error) {
+	return serialbroker.Control{}, ErrUnsupported
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// Interval at which status is reported to the control server
+	STATUS_INTERVAL = 10 * time.Second
+)
+
+// Status of an agent as reported to the control server
+type Status struct {
+	Channel   string `json:"channel"`
+	Link      string `json:"link"`
+	Connected bool   `json:"connected"`
+	// Client is the address of the connected broker
+	Client string `json:"client,omitempty"`
+	// DeviceBytes were received from the device and written to the pty
+	DeviceBytes uint64 `json:"deviceBytes"`
+	// SandboxBytes were read from the pty and sent to the device
+	SandboxBytes uint64 `json:"sandboxBytes"`
+	// Buffered bytes are waiting for a broker to connect
+	Buffered     int       `json:"buffered"`
+	LastActivity time.Time `json:"lastActivity,omitempty"`
+}
+
+func (a *Agent) Status() Status {
+	a.clientLock.Lock()
+	defer a.clientLock.Unlock()
+
+	status := Status{
+		Channel:      a.cfg.Channel,
+		Link:         a.cfg.Link,
+		Connected:    a.client != nil,
+		DeviceBytes:  a.deviceBytes,
+		SandboxBytes: a.sandboxBytes,
+		Buffered:     a.buffer.Len(),
+		LastActivity: a.lastActivity,
+	}
+	if a.client != nil {
+		status.Client = a.client.RemoteAddr().String()
+	}
+	return status
+}
+
+func (a *Agent) reportStatus() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(STATUS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := a.postStatus(client); err != nil {
+			log.Printf("[Agent] Could not report status: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (a *Agent) postStatus(client *http.Client) error {
+	body, err := json.Marshal(a.Status())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.cfg.StatusURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("control server responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"remoto.senwize.com/internal/serialbroker"
+)
+
+var (
+	ErrUploadsDisabled = errors.New("uploads are disabled")
+
+	// Bytes written between progress events of an upload
+	UPLOAD_PROGRESS_INTERVAL int64 = 64 * 1024
+)
+
+// upload is a file being received from the broker, it is written to a
+// temporary file and renamed when complete
+type upload struct {
+	name     string
+	size     int64
+	file     *os.File
+	written  int64
+	reported int64
+}
+
+// onFile handles the file frames of a broker and returns the running upload
+func (a *Agent) onFile(conn net.Conn, up *upload, f serialbroker.Frame) *upload {
+	if f.Type == serialbroker.FrameFileData {
+		if up == nil {
+			return nil
+		}
+		if err := up.write(f.Payload); err != nil {
+			a.failUpload(conn, up, err)
+			return nil
+		}
+		if up.written-up.reported >= UPLOAD_PROGRESS_INTERVAL {
+			up.reported = up.written
+			a.reply(conn, serialbroker.FileEvent{Type: serialbroker.FileProgress, Name: up.name, Size: up.size, Written: up.written})
+		}
+		return up
+	}
+
+	e, err := f.FileEvent()
+	if err != nil {
+		log.Printf("[Agent] Dropping file frame: %v", err)
+		return up
+	}
+
+	switch e.Type {
+	case serialbroker.FileStart:
+		if up != nil {
+			up.abort()
+		}
+		up, err := a.startUpload(e)
+		if err != nil {
+			a.failUpload(conn, &upload{name: e.Name}, err)
+			return nil
+		}
+		return up
+	case serialbroker.FileEnd:
+		if up == nil {
+			return nil
+		}
+		path, err := up.finish(a.cfg.UploadDir)
+		if err != nil {
+			a.failUpload(conn, up, err)
+			return nil
+		}
+		log.Printf("[Agent] Received %s (%d bytes)", path, up.written)
+		a.reply(conn, serialbroker.FileEvent{Type: serialbroker.FileDone, Name: up.name, Size: up.size, Written: up.written, Path: path})
+		return nil
+	case serialbroker.FileError:
+		if up != nil {
+			log.Printf("[Agent] Upload of %s aborted: %s", up.name, e.Error)
+			up.abort()
+		}
+		return nil
+	}
+	return up
+}
+
+func (a *Agent) startUpload(e serialbroker.FileEvent) (*upload, error) {
+	if a.cfg.UploadDir == "" {
+		return nil, ErrUploadsDisabled
+	}
+	if err := os.MkdirAll(a.cfg.UploadDir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(a.cfg.UploadDir, "."+e.Name+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &upload{name: e.Name, size: e.Size, file: file}, nil
+}
+
+func (a *Agent) failUpload(conn net.Conn, up *upload, err error) {
+	log.Printf("[Agent] Upload of %s failed: %v", up.name, err)
+	up.abort()
+	a.reply(conn, serialbroker.FileEvent{Type: serialbroker.FileError, Name: up.name, Error: err.Error()})
+}
+
+// reply sends a file event to the broker, if it is still connected
+func (a *Agent) reply(conn net.Conn, e serialbroker.FileEvent) {
+	f, err := serialbroker.FileFrame(e)
+	if err != nil {
+		return
+	}
+
+	a.clientLock.Lock()
+	defer a.clientLock.Unlock()
+	if a.client == conn {
+		a.send(f)
+	}
+}
+
+func (up *upload) write(data []byte) error {
+	if up.size > 0 && up.written+int64(len(data)) > up.size {
+		return fmt.Errorf("file exceeds its size of %d bytes", up.size)
+	}
+	n, err := up.file.Write(data)
+	up.written += int64(n)
+	return err
+}
+
+// finish moves the complete file into the upload directory
+func (up *upload) finish(dir string) (string, error) {
+	if err := up.file.Close(); err != nil {
+		os.Remove(up.file.Name())
+		return "", err
+	}
+	if err := os.Chmod(up.file.Name(), 0o644); err != nil {
+		os.Remove(up.file.Name())
+		return "", err
+	}
+	path := filepath.Join(dir, up.name)
+	if err := os.Rename(up.file.Name(), path); err != nil {
+		os.Remove(up.file.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+// abort removes the partial file
+func (up *upload) abort() {
+	if up.file == nil {
+		return
+	}
+	up.file.Close()
+	os.Remove(up.file.Name())
+}
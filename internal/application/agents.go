@@ -0,0 +1,144 @@
+package application
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remoto.senwize.com/internal/agent"
+	"remoto.senwize.com/internal/sandbox"
+)
+
+var ErrUnknownSandbox = errors.New("status reported by unknown sandbox")
+
+// agentRegistry keeps the last status reported by the serial agents of every
+// sandbox, by ip and channel
+type agentRegistry struct {
+	lock     sync.Locker
+	statuses map[string]map[string]reportedStatus
+}
+
+type reportedStatus struct {
+	agent.Status
+	ReportedAt time.Time
+}
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{
+		lock:     &sync.Mutex{},
+		statuses: map[string]map[string]reportedStatus{},
+	}
+}
+
+func (r *agentRegistry) Set(ip net.IP, status agent.Status) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	channels, ok := r.statuses[ip.String()]
+	if !ok {
+		channels = map[string]reportedStatus{}
+		r.statuses[ip.String()] = channels
+	}
+	channels[status.Channel] = reportedStatus{Status: status, ReportedAt: time.Now()}
+}
+
+func (r *agentRegistry) Get(ip net.IP, channel string) (reportedStatus, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status, ok := r.statuses[ip.String()][channel]
+	return status, ok
+}
+
+// List returns the statuses of all channels of a sandbox, sorted by channel
+func (r *agentRegistry) List(ip net.IP) []reportedStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	statuses := make([]reportedStatus, 0, len(r.statuses[ip.String()]))
+	for _, status := range r.statuses[ip.String()] {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Channel < statuses[j].Channel
+	})
+	return statuses
+}
+
+func (r *agentRegistry) Delete(ip net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.statuses, ip.String())
+}
+
+type agentStatusDTO struct {
+	Channel      string `json:"channel"`
+	Connected    bool   `json:"connected"`
+	Client       string `json:"client,omitempty"`
+	DeviceBytes  uint64 `json:"deviceBytes"`
+	SandboxBytes uint64 `json:"sandboxBytes"`
+	Buffered     int    `json:"buffered"`
+	LastActivity int64  `json:"lastActivity,omitempty"`
+	ReportedAt   int64  `json:"reportedAt"`
+}
+
+func agentStatusToDTO(status reportedStatus) *agentStatusDTO {
+	dto := &agentStatusDTO{
+		Channel:      status.Channel,
+		Connected:    status.Connected,
+		Client:       status.Client,
+		DeviceBytes:  status.DeviceBytes,
+		SandboxBytes: status.SandboxBytes,
+		Buffered:     status.Buffered,
+		ReportedAt:   status.ReportedAt.Unix(),
+	}
+	if !status.LastActivity.IsZero() {
+		dto.LastActivity = status.LastActivity.Unix()
+	}
+	return dto
+}
+
+// httpAgentStatus receives the status of a serial agent. Agents authenticate
+// with the agent token and are identified by their address.
+func (a *Application) httpAgentStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.agentToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.agentToken)) != 1 {
+			httpErrorStatus(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		var status agent.Status
+		if ok := httpReadBody(w, r, &status); !ok {
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		sb, err := a.sandbox.Get(net.ParseIP(host))
+		if err != nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrUnknownSandbox)
+			return
+		}
+
+		// Agents without channels serve the default channel
+		if status.Channel == "" {
+			status.Channel = sandbox.DEFAULT_SERIAL_CHANNEL
+		}
+
+		a.agents.Set(sb.IP, status)
+		reported, _ := a.agents.Get(sb.IP, status.Channel)
+		a.events.Publish(EVENT_SANDBOX_AGENT, sb.Workshop, map[string]interface{}{
+			"ip":         sb.IP.String(),
+			"workshopID": sb.Workshop,
+			"agent":      agentStatusToDTO(reported),
+		})
+
+		httpResponse(w, http.StatusOK, map[string]string{"message": "OK"})
+	}
+}
@@ -0,0 +1,233 @@
+package application
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/session"
+)
+
+var (
+	ErrInvalidConnection      = errors.New("invalid connection request")
+	ErrHostNotAllowed         = errors.New("host is not allowed")
+	ErrProtocolNotAllowed     = errors.New("protocol is not allowed")
+	ErrInvalidConnectionToken = errors.New("invalid or expired connection token")
+
+	// Time a connection token can be used to open the remote desktop
+	CONNECTION_TOKEN_TTL = 30 * time.Second
+	// Protocols admins can connect with if not configured
+	CONNECTION_DEFAULT_PROTOCOLS = []string{"rdp", "vnc", "ssh"}
+	// Values of the RDP security parameter
+	connectionSecurities = map[string]bool{"": true, "any": true, "nla": true, "nla-ext": true, "tls": true, "vmconnect": true, "rdp": true}
+	// Longest username or password accepted
+	connectionMaxCredential = 256
+)
+
+// connectionPolicy limits the hosts and protocols admins can connect to.
+// Discovered sandboxes are always reachable, other hosts only if they are in
+// one of the networks.
+type connectionPolicy struct {
+	networks  []*net.IPNet
+	protocols map[string]bool
+}
+
+func newConnectionPolicy(cidrs, protocols []string) (*connectionPolicy, error) {
+	if len(protocols) == 0 {
+		protocols = CONNECTION_DEFAULT_PROTOCOLS
+	}
+
+	p := &connectionPolicy{protocols: map[string]bool{}}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection network %q: %w", cidr, err)
+		}
+		p.networks = append(p.networks, network)
+	}
+	for _, protocol := range protocols {
+		p.protocols[protocol] = true
+	}
+	return p, nil
+}
+
+func (p *connectionPolicy) allowsNetwork(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed returns nil if the admin may connect to the host
+func (a *Application) hostAllowed(admin *session.Session, ip net.IP) error {
+	if sb, err := a.sandbox.Get(ip); err == nil {
+		if !admin.CanAdminister(sb.Workshop) {
+			return ErrHostNotAllowed
+		}
+		return nil
+	}
+	// Hosts outside the sandbox pools are shared by all workshops
+	if admin.WorkshopID != "" || !a.connections.allowsNetwork(ip) {
+		return ErrHostNotAllowed
+	}
+	return nil
+}
+
+// connectionRequest is a remote desktop an admin wants to open, empty fields
+// keep the settings of the sandbox or the defaults
+type connectionRequest struct {
+	Protocol   string `json:"protocol,omitempty"`
+	Hostname   string `json:"hostname"`
+	Port       int    `json:"port,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	IgnoreCert bool   `json:"ignorecert,omitempty"`
+	Security   string `json:"security,omitempty"`
+}
+
+// connectionConfig validates the request and returns the guacd configuration
+func (a *Application) connectionConfig(admin *session.Session, req connectionRequest) (*guac.Config, error) {
+	ip := net.ParseIP(req.Hostname)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: hostname must be an IP address", ErrInvalidConnection)
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		return nil, fmt.Errorf("%w: port out of range", ErrInvalidConnection)
+	}
+	if !connectionSecurities[req.Security] {
+		return nil, fmt.Errorf("%w: unknown security mode", ErrInvalidConnection)
+	}
+	if len(req.Username) > connectionMaxCredential || len(req.Password) > connectionMaxCredential {
+		return nil, fmt.Errorf("%w: credentials too long", ErrInvalidConnection)
+	}
+	if err := a.hostAllowed(admin, ip); err != nil {
+		return nil, err
+	}
+
+	// Start from the settings of the sandbox, so admins need no credentials
+	config := guacdConfigDefaults()
+	if sb, err := a.sandbox.Get(ip); err == nil {
+		config = guacdConfigFromSandbox(config, sb)
+	}
+	config.Parameters["hostname"] = ip.String()
+	if req.Protocol != "" && req.Protocol != config.Protocol {
+		// The port of the sandbox belongs to its own protocol
+		config.Protocol = req.Protocol
+		config.Parameters["port"] = strconv.Itoa(sandbox.Connection{Protocol: req.Protocol}.RemotePort())
+	}
+	if req.Port != 0 {
+		config.Parameters["port"] = strconv.Itoa(req.Port)
+	}
+	config.Parameters["username"] = or(req.Username, config.Parameters["username"])
+	config.Parameters["password"] = or(req.Password, config.Parameters["password"])
+	config.Parameters["security"] = or(req.Security, config.Parameters["security"])
+	if req.IgnoreCert {
+		config.Parameters["ignore-cert"] = "true"
+	}
+
+	if !a.connections.protocols[config.Protocol] {
+		return nil, ErrProtocolNotAllowed
+	}
+	return config, nil
+}
+
+// connectionTokens holds the validated connections until the websocket opens them
+type connectionTokens struct {
+	lock   sync.Locker
+	tokens map[string]connectionToken
+}
+
+type connectionToken struct {
+	sessionID string
+	config    *guac.Config
+	expires   time.Time
+}
+
+func newConnectionTokens() *connectionTokens {
+	return &connectionTokens{
+		lock:   &sync.Mutex{},
+		tokens: map[string]connectionToken{},
+	}
+}
+
+// Create returns a token for the connection, valid for CONNECTION_TOKEN_TTL
+func (t *connectionTokens) Create(sessionID string, config *guac.Config) (string, time.Time, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(CONNECTION_TOKEN_TTL)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key, ct := range t.tokens {
+		if time.Now().After(ct.expires) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = connectionToken{sessionID: sessionID, config: config, expires: expires}
+	return token, expires, nil
+}
+
+// Take returns the connection of a token once, only to the session that created it
+func (t *connectionTokens) Take(sessionID, token string) (*guac.Config, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ct, ok := t.tokens[token]
+	if !ok || ct.sessionID != sessionID {
+		return nil, ErrInvalidConnectionToken
+	}
+	delete(t.tokens, token)
+	if time.Now().After(ct.expires) {
+		return nil, ErrInvalidConnectionToken
+	}
+	return ct.config, nil
+}
+
+// httpCreateConnection validates a connection request of an admin and returns
+// a short-lived token to open it with /api/ws/guacamole?token=
+func (a *Application) httpCreateConnection() http.HandlerFunc {
+	type response struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req connectionRequest
+		if ok := httpReadBody(w, r, &req); !ok {
+			return
+		}
+
+		current := session.Get(r.Context())
+		config, err := a.connectionConfig(current, req)
+		if errors.Is(err, ErrHostNotAllowed) || errors.Is(err, ErrProtocolNotAllowed) {
+			log.Printf("Admin (%s) requested a connection to (%s) that is not allowed: %v\n", current.GroupName, req.Hostname, err)
+			httpErrorStatus(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+
+		token, expires, err := a.connectionTokens.Create(current.ID, config)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		httpResponse(w, http.StatusCreated, response{Token: token, ExpiresAt: expires.Unix()})
+	}
+}
@@ -0,0 +1,256 @@
+package application
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/session"
+)
+
+var (
+	// Event types
+	EVENT_SNAPSHOT            = "snapshot"
+	EVENT_SESSION_CREATED     = "session.created"
+	EVENT_SESSION_DELETED     = "session.deleted"
+	EVENT_SESSION_TOUCHED     = "session.touched"
+	EVENT_SESSION_UPDATED     = "session.updated"
+	EVENT_SANDBOX_DISCOVERED  = "sandbox.discovered"
+	EVENT_SANDBOX_LOST        = "sandbox.lost"
+	EVENT_SANDBOX_RESERVED    = "sandbox.reserved"
+	EVENT_SANDBOX_RELEASED    = "sandbox.released"
+	EVENT_SANDBOX_AGENT       = "sandbox.agent"
+	EVENT_SANDBOX_HEALTH      = "sandbox.health"
+	EVENT_TUNNEL_CONNECTED    = "tunnel.connected"
+	EVENT_TUNNEL_DISCONNECTED = "tunnel.disconnected"
+
+	// Events buffered per subscriber, slow subscribers are disconnected
+	EVENT_BUFFER_SIZE = 64
+	// Touch events are published at most once per interval per session
+	EVENT_TOUCH_INTERVAL = 10 * time.Second
+	// Subscribers receive a new snapshot every interval, the guacd pool and
+	// serial counters change without events
+	EVENT_SNAPSHOT_INTERVAL = 15 * time.Second
+)
+
+// Event describes a change in the application state
+type Event struct {
+	Type       string      `json:"type"`
+	Time       int64       `json:"time"`
+	WorkshopID string      `json:"workshopID,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// eventBus distributes events to subscribers
+type eventBus struct {
+	lock        sync.Locker
+	subscribers map[chan Event]struct{}
+	touched     map[string]time.Time
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		lock:        &sync.Mutex{},
+		subscribers: map[chan Event]struct{}{},
+		touched:     map[string]time.Time{},
+	}
+}
+
+// Subscribe returns a channel receiving all events and a function to unsubscribe.
+// The channel is closed when the subscriber falls behind.
+func (b *eventBus) Subscribe() (chan Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c := make(chan Event, EVENT_BUFFER_SIZE)
+	b.subscribers[c] = struct{}{}
+
+	return c, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if _, ok := b.subscribers[c]; ok {
+			delete(b.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+func (b *eventBus) Publish(eventType, workshopID string, data interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	event := Event{
+		Type:       eventType,
+		Time:       time.Now().Unix(),
+		WorkshopID: workshopID,
+		Data:       data,
+	}
+	for c := range b.subscribers {
+		select {
+		case c <- event:
+		default:
+			// Subscriber can not keep up, it has to reconnect for a new snapshot
+			delete(b.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// shouldPublishTouch limits the rate of touch events per session
+func (b *eventBus) shouldPublishTouch(sessionID string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.touched[sessionID]) < EVENT_TOUCH_INTERVAL {
+		return false
+	}
+	b.touched[sessionID] = now
+	return true
+}
+
+func (b *eventBus) forgetTouch(sessionID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.touched, sessionID)
+}
+
+func (a *Application) publishSession(eventType string, s *session.Session) {
+	if s.IsAdmin {
+		return
+	}
+	if eventType == EVENT_SESSION_DELETED {
+		a.events.forgetTouch(s.ID)
+	}
+	a.events.Publish(eventType, s.WorkshopID, a.adminSessionToDTO(s))
+}
+
+// publishSessionByID publishes the current state of a session
+func (a *Application) publishSessionByID(eventType, sessionID string) {
+	if s := a.sessions.Get(sessionID); s != nil {
+		a.publishSession(eventType, s)
+	}
+}
+
+// publishQueue publishes the sessions waiting in a workshop, their positions may have changed
+func (a *Application) publishQueue(workshopID string) {
+	for _, entry := range a.queue.List(workshopID) {
+		a.publishSessionByID(EVENT_SESSION_UPDATED, entry.SessionID)
+	}
+}
+
+func (a *Application) publishSandbox(eventType string, sb *sandbox.Sandbox, groupName string) {
+	snapshot, err := a.sandbox.Get(sb.IP)
+	if err != nil {
+		snapshot = sandbox.Sandbox{IP: sb.IP, Workshop: sb.Workshop}
+	}
+	a.events.Publish(eventType, sb.Workshop, a.adminSandboxToDTO(snapshot, groupName))
+}
+
+func (a *Application) httpAdminEvents() http.HandlerFunc {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+
+	return func(rw http.ResponseWriter, r *http.Request) {
+		workshopID := adminWorkshopFilter(r)
+
+		// Subscribe before the snapshot so no event is missed
+		events, unsubscribe := a.events.Subscribe()
+		defer unsubscribe()
+
+		ws, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		// Detect the admin closing the connection
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		snapshot := func() error {
+			return ws.WriteJSON(Event{
+				Type:       EVENT_SNAPSHOT,
+				Time:       time.Now().Unix(),
+				WorkshopID: workshopID,
+				Data:       a.adminSummary(workshopID),
+			})
+		}
+
+		// Initial snapshot
+		if err := snapshot(); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(EVENT_SNAPSHOT_INTERVAL)
+		defer ticker.Stop()
+
+		// Deltas
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				if err := snapshot(); err != nil {
+					return
+				}
+			case event, ok := <-events:
+				if !ok {
+					log.Printf("[Events] Subscriber fell behind, disconnecting")
+					return
+				}
+				if workshopID != "" && event.WorkshopID != workshopID {
+					continue
+				}
+				if err := ws.WriteJSON(event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *Application) onTunnelConnect(id string, r *http.Request) {
+	ses := session.Get(r.Context())
+	if ses == nil {
+		return
+	}
+	a.events.Publish(EVENT_TUNNEL_CONNECTED, ses.WorkshopID, tunnelEvent{
+		ConnectionID: id,
+		SessionID:    ses.ID,
+		GroupName:    ses.GroupName,
+	})
+}
+
+func (a *Application) onTunnelDisconnect(id string, r *http.Request) {
+	ses := session.Get(r.Context())
+	if ses == nil {
+		return
+	}
+	a.tunnels.Remove(ses.ID, id)
+	a.events.Publish(EVENT_TUNNEL_DISCONNECTED, ses.WorkshopID, tunnelEvent{
+		ConnectionID: id,
+		SessionID:    ses.ID,
+		GroupName:    ses.GroupName,
+	})
+}
+
+type tunnelEvent struct {
+	ConnectionID string `json:"connectionID"`
+	SessionID    string `json:"sessionID"`
+	GroupName    string `json:"groupName"`
+}
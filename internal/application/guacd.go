@@ -0,0 +1,260 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/discovery"
+	"remoto.senwize.com/internal/sandbox"
+)
+
+var (
+	ErrNoGuacd = errors.New("no guacd discovered")
+
+	// Time to connect to a guacd
+	GUACD_DIAL_TIMEOUT = 5 * time.Second
+	// Time a guacd that failed is only tried after the healthy ones
+	GUACD_FAILURE_BACKOFF = 30 * time.Second
+)
+
+// GuacdStrategy selects the guacd new connections are made through
+type GuacdStrategy string
+
+const (
+	// GuacdLeastConnections picks the guacd with the fewest active tunnels
+	GuacdLeastConnections GuacdStrategy = "least-connections"
+	// GuacdRoundRobin picks the guacds in turn
+	GuacdRoundRobin GuacdStrategy = "round-robin"
+)
+
+// guacdPool balances tunnels over the discovered guacds. A guacd that fails
+// to connect is tried after the others until GUACD_FAILURE_BACKOFF passed.
+type guacdPool struct {
+	lock     sync.Locker
+	strategy GuacdStrategy
+	next     int
+	states   map[string]*guacdState
+}
+
+type guacdState struct {
+	Active      int
+	Connections uint64
+	Health      sandbox.Health
+	LastError   string
+	LastFailure time.Time
+}
+
+func newGuacdPool(strategy GuacdStrategy) (*guacdPool, error) {
+	switch strategy {
+	case "":
+		strategy = GuacdLeastConnections
+	case GuacdLeastConnections, GuacdRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown guacd strategy: %s", strategy)
+	}
+
+	return &guacdPool{
+		lock:     &sync.Mutex{},
+		strategy: strategy,
+		states:   map[string]*guacdState{},
+	}, nil
+}
+
+// guacdAddr returns the address of a guacd, using GUACD_DEFAULT_PORT if
+// discovery did not provide a port
+func guacdAddr(guacd discovery.Instance) string {
+	port := guacd.Port
+	if port == 0 {
+		port = GUACD_DEFAULT_PORT
+	}
+	return net.JoinHostPort(guacd.IP.String(), strconv.Itoa(port))
+}
+
+// state returns the state of a guacd, the lock must be held
+func (p *guacdPool) state(addr string) *guacdState {
+	state, ok := p.states[addr]
+	if !ok {
+		state = &guacdState{Health: sandbox.HealthUnknown}
+		p.states[addr] = state
+	}
+	return state
+}
+
+// order returns the guacds in the order they should be tried
+func (p *guacdPool) order(guacds []discovery.Instance) []discovery.Instance {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ordered := append([]discovery.Instance(nil), guacds...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return guacdAddr(ordered[i]) < guacdAddr(ordered[j])
+	})
+
+	switch p.strategy {
+	case GuacdRoundRobin:
+		if len(ordered) > 0 {
+			n := p.next % len(ordered)
+			ordered = append(ordered[n:], ordered[:n]...)
+			p.next++
+		}
+	case GuacdLeastConnections:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return p.state(guacdAddr(ordered[i])).Active < p.state(guacdAddr(ordered[j])).Active
+		})
+	}
+
+	// Recently failed guacds are a last resort
+	backingOff := func(guacd discovery.Instance) bool {
+		state := p.state(guacdAddr(guacd))
+		return state.Health == sandbox.HealthUnhealthy && time.Since(state.LastFailure) < GUACD_FAILURE_BACKOFF
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !backingOff(ordered[i]) && backingOff(ordered[j])
+	})
+	return ordered
+}
+
+// connected counts a tunnel through the guacd
+func (p *guacdPool) connected(addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	state := p.state(addr)
+	state.Active++
+	state.Connections++
+	state.Health = sandbox.HealthHealthy
+	state.LastError = ""
+}
+
+// disconnected releases a tunnel counted by connected
+func (p *guacdPool) disconnected(addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if state := p.state(addr); state.Active > 0 {
+		state.Active--
+	}
+}
+
+func (p *guacdPool) failed(addr string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	state := p.state(addr)
+	state.Health = sandbox.HealthUnhealthy
+	state.LastError = err.Error()
+	state.LastFailure = time.Now()
+}
+
+// forget drops the state of a guacd that is no longer discovered
+func (p *guacdPool) forget(guacd discovery.Instance) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.states, guacdAddr(guacd))
+}
+
+type guacdDTO struct {
+	Addr        string `json:"addr"`
+	Active      int    `json:"active"`
+	Connections uint64 `json:"connections"`
+	Health      string `json:"health"`
+	LastError   string `json:"lastError,omitempty"`
+	LastFailure int64  `json:"lastFailure,omitempty"`
+}
+
+// list returns the state of the guacds, sorted by address
+func (p *guacdPool) list(guacds []discovery.Instance) []guacdDTO {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	dtos := make([]guacdDTO, 0, len(guacds))
+	for _, guacd := range guacds {
+		addr := guacdAddr(guacd)
+		state := p.state(addr)
+		dto := guacdDTO{
+			Addr:        addr,
+			Active:      state.Active,
+			Connections: state.Connections,
+			Health:      string(state.Health),
+			LastError:   state.LastError,
+		}
+		if !state.LastFailure.IsZero() {
+			dto.LastFailure = state.LastFailure.Unix()
+		}
+		dtos = append(dtos, dto)
+	}
+	sort.Slice(dtos, func(i, j int) bool {
+		return dtos[i].Addr < dtos[j].Addr
+	})
+	return dtos
+}
+
+// dialGuacdPool connects through the first guacd of the pool that accepts the
+// connection, the returned tunnel counts as active on that guacd until closed
+func (a *Application) dialGuacdPool(config *guac.Config) (guac.Tunnel, discovery.Instance, error) {
+	guacds := a.guacds.order(a.discovery.Get(DISCOVERY_GUACD))
+	if len(guacds) == 0 {
+		return nil, discovery.Instance{}, ErrNoGuacd
+	}
+
+	var err error
+	for _, guacd := range guacds {
+		var stream *guac.Stream
+		stream, err = dialGuacd(guacd, config)
+		if err != nil {
+			log.Printf("Could not connect through guacd at (%s), trying the next: %v\n", guacdAddr(guacd), err)
+			a.guacds.failed(guacdAddr(guacd), err)
+			continue
+		}
+		return a.guacdTunnel(guacd, stream), guacd, nil
+	}
+	return nil, discovery.Instance{}, fmt.Errorf("all guacds failed, last error: %w", err)
+}
+
+// guacdTunnel counts the tunnel as active on the guacd until it is closed
+func (a *Application) guacdTunnel(guacd discovery.Instance, stream *guac.Stream) guac.Tunnel {
+	addr := guacdAddr(guacd)
+	a.guacds.connected(addr)
+	return &countedTunnel{
+		Tunnel: guac.NewSimpleTunnel(stream),
+		closed: func() { a.guacds.disconnected(addr) },
+	}
+}
+
+// countedTunnel calls closed once when the tunnel is closed
+type countedTunnel struct {
+	guac.Tunnel
+	once   sync.Once
+	closed func()
+}
+
+func (t *countedTunnel) Close() error {
+	t.once.Do(t.closed)
+	return t.Tunnel.Close()
+}
+
+// dialGuacd connects to guacd and performs the handshake, setting
+// config.ConnectionID joins an existing connection
+func dialGuacd(guacd discovery.Instance, config *guac.Config) (*guac.Stream, error) {
+	conn, err := net.DialTimeout("tcp", guacdAddr(guacd), GUACD_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create tunnel
+	stream := guac.NewStream(conn, guac.SocketTimeout)
+	if err := stream.Handshake(config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
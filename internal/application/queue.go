@@ -0,0 +1,235 @@
+package application
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/storage"
+)
+
+var (
+	ErrNotQueued       = errors.New("session is not queued")
+	ErrInvalidPosition = errors.New("position is outside of the queue")
+
+	// Storage key
+	QUEUE_STORAGE_KEY = "queue"
+)
+
+// queueEntry is a session waiting for a sandbox
+type queueEntry struct {
+	SessionID  string    `json:"sessionID"`
+	WorkshopID string    `json:"workshopID"`
+	Since      time.Time `json:"since"`
+}
+
+// waitingQueue holds sessions waiting for a sandbox, first in first out per workshop
+type waitingQueue struct {
+	lock    sync.Locker
+	entries []queueEntry
+	storage storage.Store
+}
+
+func newWaitingQueue(store storage.Store) *waitingQueue {
+	q := &waitingQueue{
+		lock:    &sync.Mutex{},
+		storage: store,
+	}
+	q.restore()
+	return q
+}
+
+// Push adds a session to the back of the queue and returns its position
+func (q *waitingQueue) Push(workshopID, sessionID string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.entries = append(q.entries, queueEntry{
+		SessionID:  sessionID,
+		WorkshopID: workshopID,
+		Since:      time.Now(),
+	})
+	q.persist()
+	return q.position(sessionID)
+}
+
+// Peek returns the first session waiting in a workshop
+func (q *waitingQueue) Peek(workshopID string) (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, entry := range q.entries {
+		if entry.WorkshopID == workshopID {
+			return entry.SessionID, true
+		}
+	}
+	return "", false
+}
+
+// Remove removes a session from the queue, returns false if it was not queued
+func (q *waitingQueue) Remove(sessionID string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ix := q.index(sessionID)
+	if ix == -1 {
+		return false
+	}
+	q.entries = append(q.entries[:ix], q.entries[ix+1:]...)
+	q.persist()
+	return true
+}
+
+// Move places a session at a position within its workshop's queue, starting at 1
+func (q *waitingQueue) Move(sessionID string, position int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ix := q.index(sessionID)
+	if ix == -1 {
+		return ErrNotQueued
+	}
+	entry := q.entries[ix]
+	if position < 1 || position > q.length(entry.WorkshopID) {
+		return ErrInvalidPosition
+	}
+	q.entries = append(q.entries[:ix], q.entries[ix+1:]...)
+
+	// Find the index of the entry currently at the position in this workshop
+	target := len(q.entries)
+	count := 0
+	for i, e := range q.entries {
+		if e.WorkshopID != entry.WorkshopID {
+			continue
+		}
+		count++
+		if count == position {
+			target = i
+			break
+		}
+	}
+
+	q.entries = append(q.entries, queueEntry{})
+	copy(q.entries[target+1:], q.entries[target:])
+	q.entries[target] = entry
+	q.persist()
+	return nil
+}
+
+// Position returns the position of a session within its workshop's queue
+// starting at 1, or 0 if the session is not queued
+func (q *waitingQueue) Position(sessionID string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.position(sessionID)
+}
+
+// List returns the queue of a workshop, or of all workshops if workshopID is empty
+func (q *waitingQueue) List(workshopID string) []queueEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entries := make([]queueEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		if workshopID == "" || entry.WorkshopID == workshopID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// restore loads the queue persisted before the last shutdown
+func (q *waitingQueue) restore() {
+	err := q.storage.Load(QUEUE_STORAGE_KEY, &q.entries)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error while restoring queue: %v", err)
+		return
+	}
+	log.Printf("Restored %d queued sessions", len(q.entries))
+}
+
+// persist saves the queue to storage, must be called with the lock held
+func (q *waitingQueue) persist() {
+	if err := q.storage.Save(QUEUE_STORAGE_KEY, q.entries); err != nil {
+		log.Printf("Error while persisting queue: %v", err)
+	}
+}
+
+func (q *waitingQueue) index(sessionID string) int {
+	for ix, entry := range q.entries {
+		if entry.SessionID == sessionID {
+			return ix
+		}
+	}
+	return -1
+}
+
+// length returns the number of sessions waiting in a workshop
+func (q *waitingQueue) length(workshopID string) int {
+	length := 0
+	for _, entry := range q.entries {
+		if entry.WorkshopID == workshopID {
+			length++
+		}
+	}
+	return length
+}
+
+func (q *waitingQueue) position(sessionID string) int {
+	ix := q.index(sessionID)
+	if ix == -1 {
+		return 0
+	}
+
+	position := 0
+	for _, entry := range q.entries[:ix+1] {
+		if entry.WorkshopID == q.entries[ix].WorkshopID {
+			position++
+		}
+	}
+	return position
+}
+
+// releaseSandbox releases a sandbox and hands it to the next waiting session
+func (a *Application) releaseSandbox(sb *sandbox.Sandbox) {
+	a.sandbox.Release(sb)
+	a.publishSandbox(EVENT_SANDBOX_RELEASED, sb, "")
+	a.assignQueued(sb.Workshop)
+}
+
+// assignQueued assigns free sandboxes to the sessions waiting in a workshop
+func (a *Application) assignQueued(workshopID string) {
+	a.queueLock.Lock()
+	defer a.queueLock.Unlock()
+
+	for {
+		sessionID, ok := a.queue.Peek(workshopID)
+		if !ok {
+			return
+		}
+
+		sb, err := a.sandbox.ReserveFree(workshopID)
+		if err != nil {
+			return
+		}
+
+		a.queue.Remove(sessionID)
+		if err := a.sessions.SetSandbox(sessionID, sb); err != nil {
+			// Session is gone, keep the sandbox for the next in line
+			a.sandbox.Release(sb)
+			continue
+		}
+		log.Printf("Assigned sandbox %s to queued session %s", sb.IP, sessionID)
+		if ses := a.sessions.Get(sessionID); ses != nil {
+			a.publishSession(EVENT_SESSION_UPDATED, ses)
+			a.publishSandbox(EVENT_SANDBOX_RESERVED, sb, ses.GroupName)
+		}
+		a.publishQueue(workshopID)
+	}
+}
@@ -0,0 +1,54 @@
+package application
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"remoto.senwize.com/internal/storage"
+)
+
+func queueOrder(q *waitingQueue, workshopID string) []string {
+	var ids []string
+	for _, entry := range q.List(workshopID) {
+		ids = append(ids, entry.SessionID)
+	}
+	return ids
+}
+
+func TestQueueMove(t *testing.T) {
+	tests := []struct {
+		position int
+		err      error
+		want     []string
+	}{
+		{1, nil, []string{"c", "a", "b"}},
+		{2, nil, []string{"a", "c", "b"}},
+		{3, nil, []string{"a", "b", "c"}},
+		{0, ErrInvalidPosition, []string{"a", "b", "c"}},
+		{-1, ErrInvalidPosition, []string{"a", "b", "c"}},
+		{4, ErrInvalidPosition, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		q := newWaitingQueue(storage.NewMemory())
+		q.Push("w", "a")
+		q.Push("other", "x")
+		q.Push("w", "b")
+		q.Push("w", "c")
+
+		if err := q.Move("c", test.position); !errors.Is(err, test.err) {
+			t.Errorf("position %d: got error %v, want %v", test.position, err, test.err)
+		}
+		if got := queueOrder(q, "w"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("position %d: queue is %v, want %v", test.position, got, test.want)
+		}
+		if got := queueOrder(q, "other"); !reflect.DeepEqual(got, []string{"x"}) {
+			t.Errorf("position %d: other workshop is %v", test.position, got)
+		}
+	}
+
+	q := newWaitingQueue(storage.NewMemory())
+	if err := q.Move("missing", 1); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("moving a session that is not queued: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package application
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/storage"
+)
+
+var (
+	REAPER_INTERVAL = 30 * time.Second
+
+	// Storage key
+	RECLAIM_STORAGE_KEY = "reclaims"
+)
+
+// reclaim is a sandbox of an expired session that is kept reserved so the
+// group can get it back when it returns within the grace period
+type reclaim struct {
+	sandbox *sandbox.Sandbox
+	until   time.Time
+}
+
+// reclaimRecord is the persisted form of a reclaim
+type reclaimRecord struct {
+	Key       string    `json:"key"`
+	Workshop  string    `json:"workshop"`
+	SandboxIP net.IP    `json:"sandboxIP"`
+	Until     time.Time `json:"until"`
+}
+
+// reclaimList holds reclaimable sandboxes by workshop and group name
+type reclaimList struct {
+	lock    sync.Locker
+	items   map[string]reclaim
+	storage storage.Store
+}
+
+func newReclaimList(store storage.Store) *reclaimList {
+	l := &reclaimList{
+		lock:    &sync.Mutex{},
+		items:   map[string]reclaim{},
+		storage: store,
+	}
+	l.restore()
+	return l
+}
+
+func (l *reclaimList) Add(workshopID, groupName string, sandbox *sandbox.Sandbox, until time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.items[reclaimKey(workshopID, groupName)] = reclaim{sandbox: sandbox, until: until}
+	l.persist()
+}
+
+// Take removes and returns the reclaimable sandbox of a group, or nil
+func (l *reclaimList) Take(workshopID, groupName string) *sandbox.Sandbox {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	key := reclaimKey(workshopID, groupName)
+	item, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	delete(l.items, key)
+	l.persist()
+	return item.sandbox
+}
+
+// Holds returns true if the sandbox is kept for a group to reclaim
+func (l *reclaimList) Holds(ip net.IP) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, item := range l.items {
+		if item.sandbox.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired removes and returns all sandboxes whose grace period has passed
+func (l *reclaimList) Expired() []*sandbox.Sandbox {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	var expired []*sandbox.Sandbox
+	for key, item := range l.items {
+		if now.After(item.until) {
+			expired = append(expired, item.sandbox)
+			delete(l.items, key)
+		}
+	}
+	if len(expired) > 0 {
+		l.persist()
+	}
+	return expired
+}
+
+// restore loads the reclaimable sandboxes persisted before the last shutdown,
+// their reservations are restored by the sandbox service
+func (l *reclaimList) restore() {
+	var records []reclaimRecord
+	err := l.storage.Load(RECLAIM_STORAGE_KEY, &records)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error while restoring reclaims: %v", err)
+		return
+	}
+
+	for _, r := range records {
+		l.items[r.Key] = reclaim{
+			sandbox: &sandbox.Sandbox{IP: r.SandboxIP, Workshop: r.Workshop, Reserved: true},
+			until:   r.Until,
+		}
+	}
+	log.Printf("Restored %d reclaimable sandboxes", len(records))
+}
+
+// persist saves the reclaimable sandboxes to storage, must be called with the lock held
+func (l *reclaimList) persist() {
+	records := make([]reclaimRecord, 0, len(l.items))
+	for key, item := range l.items {
+		records = append(records, reclaimRecord{
+			Key:       key,
+			Workshop:  item.sandbox.Workshop,
+			SandboxIP: item.sandbox.IP,
+			Until:     item.until,
+		})
+	}
+
+	if err := l.storage.Save(RECLAIM_STORAGE_KEY, records); err != nil {
+		log.Printf("Error while persisting reclaims: %v", err)
+	}
+}
+
+func reclaimKey(workshopID, groupName string) string {
+	return workshopID + "/" + strings.ToLower(groupName)
+}
+
+func (a *Application) startReaper() func() {
+	shutdown := make(chan struct{})
+
+	// Nothing to reap
+	if a.idleTimeout == 0 && a.sessionTimeout == 0 {
+		return func() {}
+	}
+
+	// Reaper co-routine
+	go func() {
+		log.Printf("Starting session reaper")
+		defer log.Printf("Stopping session reaper")
+
+		ticker := time.NewTicker(REAPER_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdown:
+				return
+			case <-ticker.C:
+				a.reap()
+			}
+		}
+	}()
+
+	return func() {
+		close(shutdown)
+	}
+}
+
+// reap expires inactive sessions and releases their sandboxes
+func (a *Application) reap() {
+	for _, ses := range a.sessions.Expire(a.idleTimeout, a.sessionTimeout) {
+		a.serial.Forget(ses.ID)
+		a.forgetTransfers(ses.ID)
+		if a.queue.Remove(ses.ID) {
+			a.publishQueue(ses.WorkshopID)
+		}
+		a.publishSession(EVENT_SESSION_DELETED, &ses)
+		a.onSessionExpired(ses)
+	}
+
+	for _, sb := range a.reclaims.Expired() {
+		log.Printf("Reclaim grace period for sandbox %s passed", sb.IP)
+		a.releaseSandbox(sb)
+	}
+}
+
+func (a *Application) onSessionExpired(ses session.Session) {
+	log.Printf("Session expired: %s", ses.GroupName)
+	if ses.Sandbox == nil {
+		return
+	}
+
+	// Keep the sandbox reserved for a while so the group can get it back
+	if a.reclaimGrace > 0 {
+		a.reclaims.Add(ses.WorkshopID, ses.GroupName, ses.Sandbox, time.Now().Add(a.reclaimGrace))
+		return
+	}
+
+	a.releaseSandbox(ses.Sandbox)
+}
@@ -0,0 +1,110 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"remoto.senwize.com/internal/recording"
+	"remoto.senwize.com/internal/session"
+)
+
+var ErrRecordingDisabled = errors.New("recording is disabled")
+
+type recordingDTO struct {
+	ID         string `json:"id"`
+	WorkshopID string `json:"workshopID"`
+	SessionID  string `json:"sessionID"`
+	GroupName  string `json:"groupName"`
+	StartedAt  int64  `json:"startedAt"`
+	EndedAt    int64  `json:"endedAt,omitempty"`
+	Size       int64  `json:"size"`
+}
+
+func recordingToDTO(rec recording.Recording) recordingDTO {
+	dto := recordingDTO{
+		ID:         rec.ID,
+		WorkshopID: rec.WorkshopID,
+		SessionID:  rec.SessionID,
+		GroupName:  rec.GroupName,
+		StartedAt:  rec.StartedAt.Unix(),
+		Size:       rec.Size,
+	}
+	if !rec.EndedAt.IsZero() {
+		dto.EndedAt = rec.EndedAt.Unix()
+	}
+	return dto
+}
+
+// httpListRecordings lists recordings, optionally filtered by the session
+// and group query parameters
+func (a *Application) httpListRecordings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.recordings == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrRecordingDisabled)
+			return
+		}
+
+		recordings, err := a.recordings.List(adminWorkshopFilter(r))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		q := r.URL.Query()
+		sessionID, groupName := q.Get("session"), q.Get("group")
+		dtoRecordings := make([]recordingDTO, 0, len(recordings))
+		for _, rec := range recordings {
+			if sessionID != "" && rec.SessionID != sessionID {
+				continue
+			}
+			if groupName != "" && rec.GroupName != groupName {
+				continue
+			}
+			dtoRecordings = append(dtoRecordings, recordingToDTO(rec))
+		}
+
+		httpResponse(w, http.StatusOK, dtoRecordings)
+	}
+}
+
+// httpServeRecording serves the instruction stream of a recording, which can
+// be played back with Guacamole.SessionRecording. Range requests are
+// supported so playback can start before the whole recording is loaded.
+func (a *Application) httpServeRecording(download bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.recordings == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrRecordingDisabled)
+			return
+		}
+
+		current := session.Get(r.Context())
+		rec, err := a.recordings.Get(chi.URLParam(r, "recordingID"))
+		if errors.Is(err, recording.ErrNotFound) {
+			httpErrorStatus(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if !current.CanAdminister(rec.WorkshopID) {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		f, err := a.recordings.Open(rec.ID)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer f.Close()
+
+		if download {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.ID+".guac"))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, rec.ID+".guac", rec.StartedAt, f)
+	}
+}
@@ -11,39 +11,91 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/wwt/guac"
-	"remoto.senwize.com/internal/serialbroker"
+	"remoto.senwize.com/internal/sandbox"
 	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/workshop"
 )
 
 var (
 	cookieSessionID = "sid"
+
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrSessionNotFound = errors.New("session not found")
+	ErrInvalidCode     = errors.New("invalid workshop code")
+
+	// Time allowed for requests that move files, instead of the server timeouts
+	HTTP_TRANSFER_TIMEOUT = 5 * time.Minute
 )
 
+// connKey is the context key of the connection of a request
+type connKey struct{}
+
 func (a *Application) registerRoutes() {
 	r := a.router
 
 	r.Use(a.sessionMiddleware())
 	r.Get("/api/health", a.httpHealthCheck())
-	r.Get("/api/sandboxes", a.httpListSandboxes())
 	r.Get("/api/sessions/current", a.httpGetSession())
 	r.Post("/api/sessions", a.httpCreateSession())
-	r.Delete("/api/sessions/{sessionID}", a.httpDeleteSession())
-	r.Get("/api/admin/summary", a.httpAdminSummary())
-	r.Post("/api/sessions/{sessionID}/sandbox", a.httpAssignSandbox())
+	r.Post("/api/agents/status", a.httpAgentStatus())
+
+	// Routes that require a session
+	r.Group(func(r chi.Router) {
+		r.Use(requireSession())
+		r.Delete("/api/sessions/{sessionID}", a.httpDeleteSession())
+		r.With(extendDeadline(HTTP_TRANSFER_TIMEOUT)).Post("/api/serial/files", a.httpSerialUpload())
+		r.Get("/api/transfer/files", a.httpListTransfers())
+		r.With(extendDeadline(HTTP_TRANSFER_TIMEOUT)).Post("/api/transfer/files", a.httpUploadTransfer())
+		r.With(extendDeadline(HTTP_TRANSFER_TIMEOUT)).Get("/api/transfer/files/{name}", a.httpDownloadTransfer())
+		r.Delete("/api/transfer/files/{name}", a.httpDeleteTransfer())
+	})
+
+	// Guacamole connection sharing
+	shadowServer := guac.NewWebsocketServer(a.onGuacShadow)
+	shadowServer.OnConnect = a.onShadowConnect
+	shadowServer.OnDisconnect = a.onShadowDisconnect
+
+	// Routes that require an admin session
+	r.Group(func(r chi.Router) {
+		r.Use(requireAdmin())
+		r.Get("/api/sandboxes", a.httpListSandboxes())
+		r.Get("/api/workshops", a.httpListWorkshops())
+		r.Get("/api/admin/summary", a.httpAdminSummary())
+		r.Post("/api/admin/connections", a.httpCreateConnection())
+		r.With(extendDeadline(HTTP_TRANSFER_TIMEOUT)).Post("/api/admin/handouts", a.httpPushHandout())
+		r.Get("/api/admin/events", a.httpAdminEvents())
+		r.Handle("/api/admin/sessions/{sessionID}/shadow", shadowServer)
+		r.Post("/api/sessions/{sessionID}/sandbox", a.httpAssignSandbox())
+		r.Get("/api/admin/queue", a.httpListQueue())
+		r.Post("/api/admin/queue/{sessionID}/position", a.httpMoveQueued())
+		r.Delete("/api/admin/queue/{sessionID}", a.httpRemoveQueued())
+		r.Get("/api/admin/sessions/{sessionID}/serial", a.httpSerialTap())
+		r.Get("/api/admin/sessions/{sessionID}/serial/transcript", a.httpSerialTranscript())
+		r.Get("/api/admin/recordings", a.httpListRecordings())
+		r.Get("/api/admin/recordings/{recordingID}", a.httpServeRecording(true))
+		r.Get("/api/admin/recordings/{recordingID}/stream", a.httpServeRecording(false))
+	})
 
 	// Guacamole
 	wsServer := guac.NewWebsocketServer(a.onGuacConnect)
 	sessions := guac.NewMemorySessionStore()
-	wsServer.OnConnect = sessions.Add
-	wsServer.OnDisconnect = sessions.Delete
+	wsServer.OnConnect = func(id string, r *http.Request) {
+		sessions.Add(id, r)
+		a.onTunnelConnect(id, r)
+	}
+	wsServer.OnDisconnect = func(id string, r *http.Request, tunnel guac.Tunnel) {
+		sessions.Delete(id, r, tunnel)
+		a.onTunnelDisconnect(id, r)
+	}
 	r.Handle("/api/ws/guacamole", wsServer)
 
 	// Serial tunnel
-	serialtunnel := serialbroker.HandleWebsocket(orInt(os.Getenv("REMOTO_REMOTE_SERIAL_PORT"), 5000))
-	r.Handle("/api/ws/serial", serialtunnel)
+	r.Handle("/api/ws/serial", a.serial.HandleWebsocket())
 
 	// SPA delivery
 	wd, _ := os.Getwd()
@@ -80,6 +132,15 @@ func (a *Application) httpGetSession() http.HandlerFunc {
 		}
 
 		dto := sessionToDTO(ses)
+		dto.QueuePosition = a.queue.Position(ses.ID)
+		dto.Waiting = ses.Sandbox == nil && !ses.IsAdmin
+		dto.Watched = a.tunnels.Watched(ses.ID)
+		dto.FileTransfer = a.transfers != nil && !ses.IsAdmin && a.transferEnabled(ses.WorkshopID) && a.transferSupported(ses)
+		if ses.Sandbox != nil {
+			for _, channel := range a.sandboxConnection(ses.Sandbox.IP).Channels() {
+				dto.SerialChannels = append(dto.SerialChannels, channel.Name)
+			}
+		}
 
 		// Return session
 		httpResponse(w, http.StatusOK, dto)
@@ -98,33 +159,77 @@ func (a *Application) httpCreateSession() http.HandlerFunc {
 			return
 		}
 
-		// If admin code then create admin session
-		if strings.EqualFold(req.WorkshopCode, a.adminCode) {
-			session := a.sessions.Create(req.GroupName)
-			session.IsAdmin = true
+		if strings.TrimSpace(req.WorkshopCode) == "" {
+			httpErrorStatus(w, http.StatusUnauthorized, ErrInvalidCode)
+			return
+		}
+
+		// If admin code then create admin session for all workshops, there is
+		// no global admin if the admin code is not configured
+		if a.adminCode != "" && strings.EqualFold(req.WorkshopCode, a.adminCode) {
+			session := a.sessions.Create("", req.GroupName, true)
+			setCookie(w, cookieSessionID, session.ID)
+			httpResponse(w, http.StatusOK, sessionToDTO(session))
+			return
+		}
+
+		// If workshop admin code then create admin session for that workshop
+		if ws, err := a.workshops.ByAdminCode(req.WorkshopCode); err == nil {
+			session := a.sessions.Create(ws.ID, req.GroupName, true)
 			setCookie(w, cookieSessionID, session.ID)
 			httpResponse(w, http.StatusOK, sessionToDTO(session))
 			return
 		}
 
 		// Validate workshop code
-		if !strings.EqualFold(req.WorkshopCode, a.workshopCode) {
-			httpError(w, errors.New("invalid workshop code"))
+		ws, err := a.workshops.ByCode(req.WorkshopCode, time.Now())
+		if errors.Is(err, workshop.ErrNotActive) {
+			httpErrorStatus(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			httpErrorStatus(w, http.StatusUnauthorized, ErrInvalidCode)
 			return
 		}
 
-		// Reserve a sandbox
-		sandbox, err := a.sandbox.ReserveFree()
+		// Returning groups get their previous sandbox back, others reserve a sandbox
+		sb := a.reclaims.Take(ws.ID, req.GroupName)
+		if sb != nil {
+			// A sandbox that is not discovered (yet) is released, the group gets another one
+			if current, err := a.sandbox.Get(sb.IP); err == nil {
+				sb = &current
+			} else {
+				a.releaseSandbox(sb)
+				sb = nil
+			}
+		}
+		if sb == nil {
+			sb, err = a.sandbox.ReserveFree(ws.ID)
+		}
+
+		// Queue the session if no sandbox is free
+		if errors.Is(err, sandbox.ErrNoSandboxFree) {
+			session := a.sessions.Create(ws.ID, req.GroupName, false)
+			dto := sessionToDTO(session)
+			dto.QueuePosition = a.queue.Push(ws.ID, session.ID)
+			a.publishSession(EVENT_SESSION_CREATED, session)
+			setCookie(w, cookieSessionID, session.ID)
+			log.Printf("Queued session %s at position %d", session.GroupName, dto.QueuePosition)
+			httpResponse(w, http.StatusOK, dto)
+			return
+		}
 		if err != nil {
 			httpError(w, err)
 			return
 		}
 
 		// Create new session
-		session := a.sessions.Create(req.GroupName)
-		session.Sandbox = sandbox
+		session := a.sessions.Create(ws.ID, req.GroupName, false)
+		a.sessions.SetSandbox(session.ID, sb)
+		a.publishSessionByID(EVENT_SESSION_CREATED, session.ID)
+		a.publishSandbox(EVENT_SANDBOX_RESERVED, sb, session.GroupName)
 		setCookie(w, cookieSessionID, session.ID)
-		log.Printf("Assigned sandbox %s to session %s", sandbox.IP, session.GroupName)
+		log.Printf("Assigned sandbox %s to session %s", sb.IP, session.GroupName)
 		httpResponse(w, http.StatusOK, sessionToDTO(session))
 	}
 }
@@ -132,17 +237,42 @@ func (a *Application) httpCreateSession() http.HandlerFunc {
 func (a *Application) httpDeleteSession() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		sessionID := chi.URLParam(r, "sessionID")
+		current := session.Get(r.Context())
+
+		// Participants may only delete their own session
+		if !current.IsAdmin && current.ID != sessionID {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
 		session := a.sessions.Get(sessionID)
 		if session == nil {
-			httpError(w, errors.New("session not found"))
+			httpErrorStatus(w, http.StatusNotFound, ErrSessionNotFound)
 			return
 		}
 
-		// Release sandbox
-		a.sandbox.Release(session.Sandbox)
+		// Admins may only delete sessions of their workshop
+		if current.ID != sessionID && !current.CanAdminister(session.WorkshopID) {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
 
 		// Delete session
 		a.sessions.Delete(sessionID)
+		a.serial.Forget(sessionID)
+		a.forgetTransfers(sessionID)
+		a.publishSession(EVENT_SESSION_DELETED, session)
+		if a.queue.Remove(sessionID) {
+			a.publishQueue(session.WorkshopID)
+		}
+
+		// Release sandbox
+		if session.Sandbox != nil {
+			a.releaseSandbox(session.Sandbox)
+		}
+		if current.ID == sessionID {
+			deleteCookie(w, cookieSessionID)
+		}
 
 		httpResponse(w, http.StatusOK, map[string]string{"message": "session deleted"})
 	}
@@ -159,18 +289,46 @@ func (a *Application) httpAssignSandbox() http.HandlerFunc {
 		}
 
 		sessionID := chi.URLParam(r, "sessionID")
+		current := session.Get(r.Context())
 
 		session := a.sessions.Get(sessionID)
-		// Release old sandbox
-		a.sandbox.Release(session.Sandbox)
+		if session == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrSessionNotFound)
+			return
+		}
+		if !current.CanAdminister(session.WorkshopID) {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		// Only sandboxes from the session's workshop can be assigned
+		ip := net.ParseIP(req.SandboxIP)
+		if sb, err := a.sandbox.Get(ip); err != nil || sb.Workshop != session.WorkshopID {
+			httpErrorStatus(w, http.StatusNotFound, sandbox.ErrNotFound)
+			return
+		}
+		if session.Sandbox != nil && session.Sandbox.IP.Equal(ip) {
+			httpResponse(w, http.StatusOK, map[string]string{"message": "Assigned"})
+			return
+		}
 
 		// Assign new sandbox
-		sandbox, err := a.sandbox.Reserve(net.ParseIP(req.SandboxIP))
+		sandbox, err := a.sandbox.Reserve(ip)
 		if err != nil {
 			httpError(w, err)
 			return
 		}
-		session.Sandbox = sandbox
+		a.sessions.SetSandbox(session.ID, sandbox)
+		a.publishSessionByID(EVENT_SESSION_UPDATED, session.ID)
+		a.publishSandbox(EVENT_SANDBOX_RESERVED, sandbox, session.GroupName)
+		if a.queue.Remove(session.ID) {
+			a.publishQueue(session.WorkshopID)
+		}
+
+		// Release old sandbox
+		if session.Sandbox != nil {
+			a.releaseSandbox(session.Sandbox)
+		}
 
 		log.Printf("Assigned sandbox %s to session %s", sandbox.IP, session.GroupName)
 		httpResponse(w, http.StatusOK, map[string]string{"message": "Assigned"})
@@ -178,61 +336,281 @@ func (a *Application) httpAssignSandbox() http.HandlerFunc {
 }
 
 func (a *Application) httpAdminSummary() http.HandlerFunc {
-	type sessionDTO struct {
-		ID         string `json:"id"`
-		Groupname  string `json:"groupName"`
-		SandboxIP  string `json:"sandboxIP,omitempty"`
-		LastActive int64  `json:"lastActive"`
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpResponse(w, http.StatusOK, a.adminSummary(adminWorkshopFilter(r)))
+	}
+}
+
+type adminSessionDTO struct {
+	ID            string `json:"id"`
+	WorkshopID    string `json:"workshopID"`
+	Groupname     string `json:"groupName"`
+	SandboxIP     string `json:"sandboxIP,omitempty"`
+	QueuePosition int    `json:"queuePosition,omitempty"`
+	TunnelActive  bool   `json:"tunnelActive,omitempty"`
+	Watchers      int    `json:"watchers,omitempty"`
+	LastActive    int64  `json:"lastActive"`
+	// Serial is the traffic of the serial tunnels, by channel
+	Serial []serialStatsDTO `json:"serial,omitempty"`
+}
+
+type serialStatsDTO struct {
+	Channel          string `json:"channel"`
+	AgentConnected   bool   `json:"agentConnected"`
+	BrowserConnected bool   `json:"browserConnected"`
+	DeviceBytes      uint64 `json:"deviceBytes"`
+	SandboxBytes     uint64 `json:"sandboxBytes"`
+	Buffered         int    `json:"buffered"`
+}
+
+type adminSandboxDTO struct {
+	IP          string `json:"ip"`
+	WorkshopID  string `json:"workshopID"`
+	SessionID   string `json:"sessionID,omitempty"`
+	Health      string `json:"health"`
+	LastError   string `json:"lastError,omitempty"`
+	LastChecked int64  `json:"lastChecked,omitempty"`
+	// Agents are the last statuses reported by the serial agents, by channel
+	Agents []*agentStatusDTO `json:"agents,omitempty"`
+}
+
+type adminSummaryDTO struct {
+	Sessions  []adminSessionDTO `json:"sessions"`
+	Sandboxes []adminSandboxDTO `json:"sandboxes"`
+	Guacds    []guacdDTO        `json:"guacds"`
+}
+
+// adminWorkshopFilter returns the workshop an admin request is limited to,
+// workshop admins only see their own workshop
+func adminWorkshopFilter(r *http.Request) string {
+	current := session.Get(r.Context())
+	if current.WorkshopID != "" {
+		return current.WorkshopID
+	}
+	return r.URL.Query().Get("workshop")
+}
+
+func (a *Application) adminSessionToDTO(s *session.Session) adminSessionDTO {
+	dto := adminSessionDTO{
+		ID:            s.ID,
+		WorkshopID:    s.WorkshopID,
+		Groupname:     s.GroupName,
+		QueuePosition: a.queue.Position(s.ID),
+		LastActive:    s.LastActive.Unix(),
 	}
-	type sandboxDTO struct {
-		IP        string `json:"ip"`
-		SessionID string `json:"sessionID,omitempty"`
+	if s.Sandbox != nil {
+		dto.SandboxIP = s.Sandbox.IP.String()
 	}
-	type response struct {
-		Sessions  []sessionDTO `json:"sessions"`
-		Sandboxes []sandboxDTO `json:"sandboxes"`
+	if tunnel, ok := a.tunnels.Get(s.ID); ok {
+		dto.TunnelActive = true
+		dto.Watchers = tunnel.Watchers
+	}
+	for _, stats := range a.serial.Stats(s.ID) {
+		dto.Serial = append(dto.Serial, serialStatsDTO{
+			Channel:          stats.Channel,
+			AgentConnected:   stats.Agent,
+			BrowserConnected: stats.Browser,
+			DeviceBytes:      stats.DeviceBytes,
+			SandboxBytes:     stats.SandboxBytes,
+			Buffered:         stats.Buffered,
+		})
+	}
+	return dto
+}
+
+func (a *Application) adminSandboxToDTO(sb sandbox.Sandbox, groupName string) adminSandboxDTO {
+	dto := adminSandboxDTO{
+		IP:         sb.IP.String(),
+		WorkshopID: sb.Workshop,
+		SessionID:  groupName,
+		Health:     string(sb.Health),
+		LastError:  sb.LastError,
+	}
+	if !sb.LastChecked.IsZero() {
+		dto.LastChecked = sb.LastChecked.Unix()
+	}
+	for _, status := range a.agents.List(sb.IP) {
+		dto.Agents = append(dto.Agents, agentStatusToDTO(status))
+	}
+	return dto
+}
+
+// adminSummary lists the sessions and sandboxes of a workshop, or of all
+// workshops if workshopID is empty
+func (a *Application) adminSummary(workshopID string) adminSummaryDTO {
+	visible := func(id string) bool {
+		return workshopID == "" || workshopID == id
+	}
+
+	// Create session dto list
+	sessions := a.sessions.List()
+	dtoSessions := make([]adminSessionDTO, 0, len(sessions))
+	sandboxSessionMap := make(map[string]string)
+
+	// Iterate sessions
+	for ix := range sessions {
+		session := &sessions[ix]
+		if session.IsAdmin || !visible(session.WorkshopID) {
+			continue
+		}
+
+		if session.Sandbox != nil {
+			sandboxSessionMap[session.Sandbox.IP.String()] = session.GroupName
+		}
+
+		dtoSessions = append(dtoSessions, a.adminSessionToDTO(session))
+	}
+
+	// Create sandbox dto list
+	sandboxes := a.sandbox.List()
+	dtoSandboxes := make([]adminSandboxDTO, 0, len(sandboxes))
+	for _, sandbox := range sandboxes {
+		if !visible(sandbox.Workshop) {
+			continue
+		}
+		dtoSandboxes = append(dtoSandboxes, a.adminSandboxToDTO(sandbox, sandboxSessionMap[sandbox.IP.String()]))
+	}
+
+	return adminSummaryDTO{
+		Sessions:  dtoSessions,
+		Sandboxes: dtoSandboxes,
+		Guacds:    a.guacds.list(a.discovery.Get(DISCOVERY_GUACD)),
+	}
+}
+
+func (a *Application) httpListWorkshops() http.HandlerFunc {
+	type workshopDTO struct {
+		ID       string `json:"id"`
+		Name     string `json:"name,omitempty"`
+		Code     string `json:"code"`
+		Active   bool   `json:"active"`
+		StartsAt int64  `json:"startsAt,omitempty"`
+		EndsAt   int64  `json:"endsAt,omitempty"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Create session dto list
-		sessions := a.sessions.List()
-		dtoSessions := make([]sessionDTO, 0, len(sessions))
-		sandboxSessionMap := make(map[string]string)
-
-		// Iterate sessions
-		for _, session := range sessions {
-			if session.IsAdmin {
+		current := session.Get(r.Context())
+		now := time.Now()
+
+		workshops := a.workshops.List()
+		dtoWorkshops := make([]workshopDTO, 0, len(workshops))
+		for _, ws := range workshops {
+			if !current.CanAdminister(ws.ID) {
 				continue
 			}
 
-			dto := sessionDTO{
-				ID:         session.ID,
-				Groupname:  session.GroupName,
-				LastActive: session.LastActive.Unix(),
+			dto := workshopDTO{
+				ID:     ws.ID,
+				Name:   ws.Name,
+				Code:   ws.Code,
+				Active: ws.Active(now),
 			}
+			if !ws.StartsAt.IsZero() {
+				dto.StartsAt = ws.StartsAt.Unix()
+			}
+			if !ws.EndsAt.IsZero() {
+				dto.EndsAt = ws.EndsAt.Unix()
+			}
+			dtoWorkshops = append(dtoWorkshops, dto)
+		}
 
-			if session.Sandbox != nil {
-				dto.SandboxIP = session.Sandbox.IP.String()
-				sandboxSessionMap[session.Sandbox.IP.String()] = session.GroupName
+		httpResponse(w, http.StatusOK, dtoWorkshops)
+	}
+}
+
+func (a *Application) httpListQueue() http.HandlerFunc {
+	type entryDTO struct {
+		SessionID  string `json:"sessionID"`
+		WorkshopID string `json:"workshopID"`
+		GroupName  string `json:"groupName"`
+		Position   int    `json:"position"`
+		Since      int64  `json:"since"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := a.queue.List(adminWorkshopFilter(r))
+		dtoEntries := make([]entryDTO, 0, len(entries))
+		for _, entry := range entries {
+			ses := a.sessions.Get(entry.SessionID)
+			if ses == nil {
+				continue
 			}
+			dtoEntries = append(dtoEntries, entryDTO{
+				SessionID:  entry.SessionID,
+				WorkshopID: entry.WorkshopID,
+				GroupName:  ses.GroupName,
+				Position:   a.queue.Position(entry.SessionID),
+				Since:      entry.Since.Unix(),
+			})
+		}
+
+		httpResponse(w, http.StatusOK, dtoEntries)
+	}
+}
 
-			dtoSessions = append(dtoSessions, dto)
+func (a *Application) httpMoveQueued() http.HandlerFunc {
+	type request struct {
+		Position int `json:"position"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if ok := httpReadBody(w, r, &req); !ok {
+			return
 		}
 
-		// Create sandbox dto list
-		sandboxes := a.sandbox.List()
-		dtoSandboxes := make([]sandboxDTO, len(sandboxes))
-		for i, sandbox := range sandboxes {
-			dtoSandboxes[i] = sandboxDTO{
-				IP:        sandbox.IP.String(),
-				SessionID: sandboxSessionMap[sandbox.IP.String()],
-			}
+		sessionID := chi.URLParam(r, "sessionID")
+		current := session.Get(r.Context())
+
+		session := a.sessions.Get(sessionID)
+		if session == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrSessionNotFound)
+			return
+		}
+		if !current.CanAdminister(session.WorkshopID) {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
 		}
 
-		// Return response
-		httpResponse(w, http.StatusOK, response{
-			Sessions:  dtoSessions,
-			Sandboxes: dtoSandboxes,
-		})
+		err := a.queue.Move(sessionID, req.Position)
+		if errors.Is(err, ErrInvalidPosition) {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			httpErrorStatus(w, http.StatusNotFound, err)
+			return
+		}
+		a.publishQueue(session.WorkshopID)
+
+		httpResponse(w, http.StatusOK, map[string]string{"message": "Moved"})
+	}
+}
+
+func (a *Application) httpRemoveQueued() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := chi.URLParam(r, "sessionID")
+		current := session.Get(r.Context())
+
+		session := a.sessions.Get(sessionID)
+		if session == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrSessionNotFound)
+			return
+		}
+		if !current.CanAdminister(session.WorkshopID) {
+			httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		// Removing a group from the queue ends its session
+		if !a.queue.Remove(sessionID) {
+			httpErrorStatus(w, http.StatusNotFound, ErrNotQueued)
+			return
+		}
+		a.sessions.Delete(sessionID)
+		a.serial.Forget(sessionID)
+		a.forgetTransfers(sessionID)
+		a.publishSession(EVENT_SESSION_DELETED, session)
+		a.publishQueue(session.WorkshopID)
+
+		httpResponse(w, http.StatusOK, map[string]string{"message": "Removed"})
 	}
 }
 
@@ -261,7 +639,10 @@ func (a *Application) sessionMiddleware() middleware {
 			}
 
 			// Update session time
-			ses.Touch()
+			a.sessions.Touch(ses.ID)
+			if a.events.shouldPublishTouch(ses.ID) {
+				a.publishSessionByID(EVENT_SESSION_TOUCHED, ses.ID)
+			}
 
 			r = r.WithContext(session.With(r.Context(), ses))
 			next.ServeHTTP(rw, r)
@@ -271,8 +652,64 @@ func (a *Application) sessionMiddleware() middleware {
 	}
 }
 
+// extendDeadline gives requests up to d to be read and answered, the read and
+// write timeouts of the server are too short to move files
+func extendDeadline(d time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		mw := func(rw http.ResponseWriter, r *http.Request) {
+			if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+				deadline := time.Now().Add(d)
+				conn.SetReadDeadline(deadline)
+				conn.SetWriteDeadline(deadline)
+			}
+			next.ServeHTTP(rw, r)
+		}
+
+		return http.HandlerFunc(mw)
+	}
+}
+
+// requireSession refuses requests that do not carry a valid session
+func requireSession() middleware {
+	return func(next http.Handler) http.Handler {
+		mw := func(rw http.ResponseWriter, r *http.Request) {
+			if session.Get(r.Context()) == nil {
+				httpErrorStatus(rw, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		}
+
+		return http.HandlerFunc(mw)
+	}
+}
+
+// requireAdmin refuses requests that do not carry a valid admin session
+func requireAdmin() middleware {
+	return func(next http.Handler) http.Handler {
+		mw := func(rw http.ResponseWriter, r *http.Request) {
+			ses := session.Get(r.Context())
+			if ses == nil {
+				httpErrorStatus(rw, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			if !ses.IsAdmin {
+				httpErrorStatus(rw, http.StatusForbidden, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		}
+
+		return http.HandlerFunc(mw)
+	}
+}
+
 func httpError(w http.ResponseWriter, err error) {
-	httpResponse(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+	httpErrorStatus(w, http.StatusInternalServerError, err)
+}
+
+func httpErrorStatus(w http.ResponseWriter, status int, err error) {
+	httpResponse(w, status, map[string]string{"message": err.Error()})
 }
 
 func httpResponse(w http.ResponseWriter, status int, v interface{}) {
@@ -318,14 +755,26 @@ func setCookie(rw http.ResponseWriter, cookie, value string) {
 }
 
 type SessionDTO struct {
-	GroupName string `json:"groupName,omitempty"`
-	IsAdmin   bool   `json:"isAdmin,omitempty"`
+	WorkshopID string `json:"workshopID,omitempty"`
+	GroupName  string `json:"groupName,omitempty"`
+	IsAdmin    bool   `json:"isAdmin,omitempty"`
+	// QueuePosition is the position in the waiting queue, 0 if not queued
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// Waiting is set while the session has no sandbox to connect to
+	Waiting bool `json:"waiting,omitempty"`
+	// Watched is set while an admin is shadowing the remote desktop
+	Watched bool `json:"watched,omitempty"`
+	// SerialChannels are the serial devices that can be forwarded to the sandbox
+	SerialChannels []string `json:"serialChannels,omitempty"`
+	// FileTransfer is set if files can be transferred through /api/transfer/files
+	FileTransfer bool `json:"fileTransfer,omitempty"`
 }
 
 func sessionToDTO(s *session.Session) *SessionDTO {
 	return &SessionDTO{
-		GroupName: s.GroupName,
-		IsAdmin:   s.IsAdmin,
+		WorkshopID: s.WorkshopID,
+		GroupName:  s.GroupName,
+		IsAdmin:    s.IsAdmin,
 	}
 }
 
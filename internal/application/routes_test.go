@@ -0,0 +1,49 @@
+package application
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/storage"
+	"remoto.senwize.com/internal/workshop"
+)
+
+// TestCreateSessionAdminCode checks that an empty code never opens an admin
+// session, also when the admin code is not configured
+func TestCreateSessionAdminCode(t *testing.T) {
+	workshops, err := workshop.New([]workshop.Workshop{{ID: "w", Code: "join", Sandboxes: "static://"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		adminCode string
+		code      string
+		status    int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "  ", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "SECRET", http.StatusOK},
+	}
+	for _, test := range tests {
+		a := &Application{
+			sessions:  session.New(storage.NewMemory()),
+			workshops: workshops,
+			adminCode: test.adminCode,
+		}
+		body := strings.NewReader(`{"workshop_code": "` + test.code + `"}`)
+		rec := httptest.NewRecorder()
+		a.httpCreateSession()(rec, httptest.NewRequest(http.MethodPost, "/api/sessions", body))
+
+		if rec.Code != test.status {
+			t.Errorf("admin code %q, code %q: status %d, want %d", test.adminCode, test.code, rec.Code, test.status)
+		}
+		if test.status != http.StatusOK && len(a.sessions.List()) != 0 {
+			t.Errorf("admin code %q, code %q: session was created", test.adminCode, test.code)
+		}
+	}
+}
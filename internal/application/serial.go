@@ -0,0 +1,158 @@
+package application
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"remoto.senwize.com/internal/serialbroker"
+	"remoto.senwize.com/internal/session"
+)
+
+var (
+	ErrInvalidEncoding = errors.New("encoding must be text or base64")
+	ErrUploadTooLarge  = errors.New("file is too large")
+
+	// Largest file participants can upload to their sandbox
+	SERIAL_UPLOAD_MAX_SIZE int64 = 16 * 1024 * 1024
+)
+
+// administeredSession returns the session from the url if the current admin
+// may administer it, writing an error response otherwise
+func (a *Application) administeredSession(w http.ResponseWriter, r *http.Request) *session.Session {
+	current := session.Get(r.Context())
+
+	ses := a.sessions.Get(chi.URLParam(r, "sessionID"))
+	if ses == nil {
+		httpErrorStatus(w, http.StatusNotFound, ErrSessionNotFound)
+		return nil
+	}
+	if !current.CanAdminister(ses.WorkshopID) {
+		httpErrorStatus(w, http.StatusForbidden, ErrForbidden)
+		return nil
+	}
+	return ses
+}
+
+// httpSerialTap lets an admin watch the serial output of a group, the channel
+// query parameter selects the serial channel
+func (a *Application) httpSerialTap() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses := a.administeredSession(w, r)
+		if ses == nil {
+			return
+		}
+
+		channel, err := serialbroker.Channel(r)
+		if err != nil {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+
+		a.serial.Tap(w, r, ses.ID, channel)
+	}
+}
+
+// httpSerialTranscript returns the recent serial traffic of a group. Data is
+// returned as text, or base64 encoded with ?encoding=base64 so binary traffic
+// is returned unchanged.
+func (a *Application) httpSerialTranscript() http.HandlerFunc {
+	type entryDTO struct {
+		Time      int64  `json:"time"`
+		Direction string `json:"direction"`
+		Data      string `json:"data"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses := a.administeredSession(w, r)
+		if ses == nil {
+			return
+		}
+
+		channel, err := serialbroker.Channel(r)
+		if err != nil {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+
+		encode := func(data []byte) string { return string(data) }
+		switch r.URL.Query().Get("encoding") {
+		case "", "text":
+		case "base64":
+			encode = base64.StdEncoding.EncodeToString
+		default:
+			httpErrorStatus(w, http.StatusBadRequest, ErrInvalidEncoding)
+			return
+		}
+
+		// A session without serial traffic has an empty transcript
+		entries, _ := a.serial.Transcript(ses.ID, channel)
+		dtoEntries := make([]entryDTO, 0, len(entries))
+		for _, entry := range entries {
+			dtoEntries = append(dtoEntries, entryDTO{
+				Time:      entry.Time.UnixMilli(),
+				Direction: string(entry.Direction),
+				Data:      encode(entry.Data),
+			})
+		}
+
+		httpResponse(w, http.StatusOK, dtoEntries)
+	}
+}
+
+// httpSerialUpload places the request body in the sandbox of the session,
+// through the agent of the serial channel. The file is named by the name query
+// parameter, the browser receives the progress over the serial websocket.
+func (a *Application) httpSerialUpload() http.HandlerFunc {
+	type responseDTO struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses := session.Get(r.Context())
+
+		channel, err := serialbroker.Channel(r)
+		if err != nil {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+		name, err := serialbroker.CleanFileName(r.URL.Query().Get("name"))
+		if err != nil {
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+		if r.ContentLength > SERIAL_UPLOAD_MAX_SIZE {
+			httpErrorStatus(w, http.StatusRequestEntityTooLarge, ErrUploadTooLarge)
+			return
+		}
+		size := r.ContentLength
+		if size < 0 {
+			size = 0
+		}
+
+		body := http.MaxBytesReader(w, r.Body, SERIAL_UPLOAD_MAX_SIZE)
+		result, err := a.serial.Upload(ses.ID, channel, name, size, body)
+		switch {
+		case err == nil:
+		case errors.Is(err, serialbroker.ErrNotConnected), errors.Is(err, serialbroker.ErrUploadBusy):
+			httpErrorStatus(w, http.StatusConflict, err)
+			return
+		case errors.Is(err, serialbroker.ErrUploadUnsupported):
+			httpErrorStatus(w, http.StatusNotImplemented, err)
+			return
+		case errors.Is(err, serialbroker.ErrUploadFailed), errors.Is(err, serialbroker.ErrUploadInterrupted), errors.Is(err, serialbroker.ErrUploadTimeout):
+			httpErrorStatus(w, http.StatusBadGateway, err)
+			return
+		default:
+			httpErrorStatus(w, http.StatusBadRequest, err)
+			return
+		}
+
+		httpResponse(w, http.StatusOK, responseDTO{
+			Name: result.Name,
+			Path: result.Path,
+			Size: result.Written,
+		})
+	}
+}
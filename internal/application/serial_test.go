@@ -0,0 +1,105 @@
+package application
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/serialbroker"
+	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/storage"
+)
+
+var (
+	testSandboxA = net.IPv4(127, 0, 0, 10)
+	testSandboxB = net.IPv4(127, 0, 0, 20)
+	testOutside  = net.IPv4(10, 1, 0, 1)
+)
+
+// newSerialTestApplication has a sandbox in workshop a and one in workshop b,
+// admins may connect to 10.1.0.0/16 outside the pools
+func newSerialTestApplication(t *testing.T) *Application {
+	t.Helper()
+	a := &Application{sandbox: sandbox.New(storage.NewMemory())}
+	a.sandbox.Add(testSandboxA, "a", sandbox.Connection{})
+	a.sandbox.Add(testSandboxB, "b", sandbox.Connection{})
+
+	var err error
+	if a.connections, err = newConnectionPolicy([]string{"10.1.0.0/16"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.serial, err = serialbroker.New(serialbroker.Config{
+		Agent:     a.sandboxSerialAgent,
+		Authorize: a.hostAllowed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestHostAllowed(t *testing.T) {
+	a := newSerialTestApplication(t)
+	workshopAdmin := &session.Session{ID: "trainer", WorkshopID: "a", IsAdmin: true}
+	globalAdmin := &session.Session{ID: "admin", IsAdmin: true}
+
+	tests := []struct {
+		admin *session.Session
+		ip    net.IP
+		allow bool
+	}{
+		{workshopAdmin, testSandboxA, true},
+		{workshopAdmin, testSandboxB, false},
+		{workshopAdmin, testOutside, false},
+		{globalAdmin, testSandboxA, true},
+		{globalAdmin, testSandboxB, true},
+		{globalAdmin, testOutside, true},
+		{globalAdmin, net.IPv4(10, 2, 0, 1), false},
+	}
+	for _, test := range tests {
+		err := a.hostAllowed(test.admin, test.ip)
+		if test.allow && err != nil {
+			t.Errorf("admin of workshop %q refused %s: %v", test.admin.WorkshopID, test.ip, err)
+		}
+		if !test.allow && !errors.Is(err, ErrHostNotAllowed) {
+			t.Errorf("admin of workshop %q allowed %s", test.admin.WorkshopID, test.ip)
+		}
+	}
+}
+
+// TestSerialTunnelRefusesOtherWorkshop checks that a workshop admin cannot
+// open the serial tunnel of a sandbox of another workshop
+func TestSerialTunnelRefusesOtherWorkshop(t *testing.T) {
+	a := newSerialTestApplication(t)
+	admin := &session.Session{ID: "trainer", GroupName: "trainer", WorkshopID: "a", IsAdmin: true}
+
+	handler := a.serial.HandleWebsocket()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(session.With(r.Context(), admin)))
+	}))
+	defer srv.Close()
+	defer a.serial.Forget(admin.ID)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?hostname=" + testSandboxB.String()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = ws.ReadMessage()
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("tunnel to the sandbox of another workshop was not closed: %v", err)
+	}
+	if stats := a.serial.Stats(admin.ID); len(stats) != 0 {
+		t.Errorf("tunnel was created: %+v", stats)
+	}
+}
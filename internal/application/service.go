@@ -10,20 +10,58 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/clipboard"
 	"remoto.senwize.com/internal/discovery"
+	"remoto.senwize.com/internal/recording"
 	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/serialbroker"
 	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/storage"
+	"remoto.senwize.com/internal/transfer"
+	"remoto.senwize.com/internal/workshop"
 )
 
 var (
-	// Service names
+	// Service names, sandbox services are suffixed with the workshop ID
 	DISCOVERY_GUACD   = "guacd"
-	DISCOVERY_SANDBOX = "sandbox"
+	DISCOVERY_SANDBOX = "sandbox:"
+
+	// Port used for guacd if discovery did not provide one
+	GUACD_DEFAULT_PORT = 4822
+
+	// Sandbox discovery metadata keys
+	META_PROTOCOL        = "protocol"
+	META_PORT            = "port"
+	META_USERNAME        = "username"
+	META_PASSWORD        = "password"
+	META_SERIAL_PORT     = "serialPort"
+	META_SERIAL_PROTOCOL = "serialProtocol"
+	META_SERIAL_CHANNELS = "serialChannels"
+	META_IGNORE_CERT     = "ignoreCert"
+	META_SECURITY        = "security"
+	META_PRIVATE_KEY     = "privateKey"
+	META_PASSPHRASE      = "passphrase"
+	META_HOST_KEY        = "hostKey"
+	META_FONT_NAME       = "fontName"
+	META_FONT_SIZE       = "fontSize"
+	META_COLOR_SCHEME    = "colorScheme"
+	META_SCROLLBACK      = "scrollback"
+	META_SFTP            = "sftp"
+	META_SFTP_ROOT       = "sftpRoot"
+	META_DISABLE_COPY    = "disableCopy"
+	META_DISABLE_PASTE   = "disablePaste"
+	META_CLIPBOARD_SIZE  = "clipboardMaxSize"
+
+	// Sandbox health checks
+	HEALTH_INTERVAL = 10 * time.Second
+	HEALTH_TIMEOUT  = 2 * time.Second
 )
 
 // Application ...
@@ -32,29 +70,182 @@ type Application struct {
 	sandbox   *sandbox.Service
 	discovery *discovery.Service
 	sessions  *session.Service
-
-	workshopCode string
-	adminCode    string
-	done         chan struct{}
+	workshops *workshop.Service
+	reclaims  *reclaimList
+	queue     *waitingQueue
+	queueLock sync.Locker
+	events    *eventBus
+	tunnels   *tunnelRegistry
+	guacds    *guacdPool
+	// connections limits where admins can connect to
+	connections      *connectionPolicy
+	connectionTokens *connectionTokens
+	// recordings is nil if recording is disabled
+	recordings *recording.Service
+	// transfers is nil if file transfer is disabled
+	transfers *transfer.Service
+	// guacdTransferDir is the transfer directory as guacd sees it
+	guacdTransferDir string
+	serial           *serialbroker.Broker
+	agents           *agentRegistry
+
+	adminCode      string
+	agentToken     string
+	idleTimeout    time.Duration
+	sessionTimeout time.Duration
+	reclaimGrace   time.Duration
+	done           chan struct{}
 }
 
 // Config ...
 type Config struct {
-	GuacdFQDN    string
-	SandboxFQDN  string
-	WorkshopCode string
-	AdminCode    string
+	// GuacdSource selects where guacd is discovered, see discovery.ParseProvider
+	GuacdSource string
+	// GuacdStrategy selects the guacd of new connections, least connections if empty
+	GuacdStrategy GuacdStrategy
+	// ConnectionNetworks are the CIDRs admins can connect to besides the sandboxes
+	ConnectionNetworks []string
+	// ConnectionProtocols are the protocols admins can connect with,
+	// CONNECTION_DEFAULT_PROTOCOLS if empty
+	ConnectionProtocols []string
+	// Workshops hosted by this server, each with its own sandbox pool
+	Workshops []workshop.Workshop
+	// AdminCode grants admin access to all workshops
+	AdminCode string
+	// StateDir is where sessions and reservations are persisted, state is
+	// kept in memory only if empty
+	StateDir string
+	// IdleTimeout expires sessions that have been inactive for this long
+	IdleTimeout time.Duration
+	// SessionTimeout expires sessions that exist for this long
+	SessionTimeout time.Duration
+	// ReclaimGrace keeps the sandbox of an expired session reserved for this
+	// long, so the returning group gets the same sandbox
+	ReclaimGrace time.Duration
+	// RecordingsDir is where session recordings are stored, recording is
+	// disabled if empty
+	RecordingsDir string
+	// TransferDir is where the files groups transfer to their sandboxes are
+	// stored, file transfer through the server is disabled if empty
+	TransferDir string
+	// GuacdTransferDir is TransferDir as mounted in guacd, TransferDir if empty
+	GuacdTransferDir string
+	// TransferQuota is the number of bytes every group may store,
+	// TRANSFER_DEFAULT_QUOTA if zero
+	TransferQuota int64
+	// TransferGID is the group guacd runs as, transfer directories are shared
+	// with it. The group of the server is kept if negative.
+	TransferGID int
+	// SerialTranscriptDir is where serial transcripts are saved, they are
+	// kept in memory only if empty
+	SerialTranscriptDir string
+	// SerialGracePeriod is how long the serial agent connection is kept for a
+	// browser to reconnect
+	SerialGracePeriod time.Duration
+	// SerialBufferSize is the number of bytes a serial tunnel buffers per
+	// direction before it holds back the sending side
+	SerialBufferSize int
+	// SerialReadBufferSize is the number of bytes read from serial agents and
+	// websockets at once
+	SerialReadBufferSize int
+	// AgentToken is shared with the serial agents of the sandboxes, it
+	// authenticates the broker to the agents and the agents to the server
+	AgentToken string
 }
 
-func New(cfg Config) *Application {
+func New(cfg Config) (*Application, error) {
+	guacdProvider, err := discovery.ParseProvider(cfg.GuacdSource)
+	if err != nil {
+		return nil, err
+	}
+	guacds, err := newGuacdPool(cfg.GuacdStrategy)
+	if err != nil {
+		return nil, err
+	}
+	connections, err := newConnectionPolicy(cfg.ConnectionNetworks, cfg.ConnectionProtocols)
+	if err != nil {
+		return nil, err
+	}
+	workshops, err := workshop.New(cfg.Workshops)
+	if err != nil {
+		return nil, err
+	}
+	if workshops.HasCode(cfg.AdminCode) {
+		return nil, fmt.Errorf("%w: admin code", workshop.ErrDuplicateCode)
+	}
+
+	var store storage.Store = storage.NewMemory()
+	if cfg.StateDir != "" {
+		fileStore, err := storage.NewFile(cfg.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+
+	var recordings *recording.Service
+	if cfg.RecordingsDir != "" {
+		recordings, err = recording.New(cfg.RecordingsDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var transfers *transfer.Service
+	if cfg.TransferDir != "" {
+		if cfg.TransferQuota <= 0 {
+			cfg.TransferQuota = TRANSFER_DEFAULT_QUOTA
+		}
+		transfers, err = transfer.New(cfg.TransferDir, cfg.TransferQuota, cfg.TransferGID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	app := &Application{
-		router:       chi.NewRouter(),
-		discovery:    discovery.New(),
-		sandbox:      sandbox.New(),
-		sessions:     session.New(),
-		done:         make(chan struct{}),
-		workshopCode: cfg.WorkshopCode,
-		adminCode:    cfg.AdminCode,
+		router:           chi.NewRouter(),
+		discovery:        discovery.New(),
+		sandbox:          sandbox.New(store),
+		sessions:         session.New(store),
+		workshops:        workshops,
+		reclaims:         newReclaimList(store),
+		queue:            newWaitingQueue(store),
+		queueLock:        &sync.Mutex{},
+		events:           newEventBus(),
+		tunnels:          newTunnelRegistry(),
+		guacds:           guacds,
+		connections:      connections,
+		connectionTokens: newConnectionTokens(),
+		recordings:       recordings,
+		transfers:        transfers,
+		guacdTransferDir: or(cfg.GuacdTransferDir, cfg.TransferDir),
+		agents:           newAgentRegistry(),
+		done:             make(chan struct{}),
+		adminCode:        cfg.AdminCode,
+		agentToken:       cfg.AgentToken,
+		idleTimeout:      cfg.IdleTimeout,
+		sessionTimeout:   cfg.SessionTimeout,
+		reclaimGrace:     cfg.ReclaimGrace,
+	}
+
+	app.serial, err = serialbroker.New(serialbroker.Config{
+		Agent:          app.sandboxSerialAgent,
+		Authorize:      app.hostAllowed,
+		TranscriptDir:  cfg.SerialTranscriptDir,
+		GracePeriod:    cfg.SerialGracePeriod,
+		BufferSize:     cfg.SerialBufferSize,
+		ReadBufferSize: cfg.SerialReadBufferSize,
+		AgentToken:     cfg.AgentToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop queued sessions that were not restored
+	for _, entry := range app.queue.List("") {
+		if app.sessions.Get(entry.SessionID) == nil {
+			app.queue.Remove(entry.SessionID)
+		}
 	}
 
 	// Register http routes
@@ -62,11 +253,18 @@ func New(cfg Config) *Application {
 
 	// Setup discovery service
 	app.discovery.OnDiscover = app.onServiceDiscovered
+	app.discovery.OnUpdate = app.onServiceUpdated
 	app.discovery.OnLost = app.onServiceLost
-	app.discovery.Add(DISCOVERY_GUACD, cfg.GuacdFQDN)
-	app.discovery.Add(DISCOVERY_SANDBOX, cfg.SandboxFQDN)
+	app.discovery.Add(DISCOVERY_GUACD, guacdProvider)
+	for _, w := range workshops.List() {
+		sandboxProvider, err := discovery.ParseProvider(w.Sandboxes)
+		if err != nil {
+			return nil, fmt.Errorf("workshop %s: %w", w.ID, err)
+		}
+		app.discovery.Add(DISCOVERY_SANDBOX+w.ID, sandboxProvider)
+	}
 
-	return app
+	return app, nil
 }
 
 func (a *Application) Serve(httpAddr string) {
@@ -78,6 +276,10 @@ func (a *Application) Serve(httpAddr string) {
 	// Start services
 	stopServiceDiscovery := a.startServiceDiscovery()
 	defer stopServiceDiscovery()
+	stopReaper := a.startReaper()
+	defer stopReaper()
+	stopHealthChecker := a.startHealthChecker()
+	defer stopHealthChecker()
 	stopHTTPServer := a.startHTTPServer(errC, httpAddr)
 	defer stopHTTPServer()
 
@@ -121,6 +323,42 @@ func (a *Application) startServiceDiscovery() func() {
 	}
 }
 
+func (a *Application) startHealthChecker() func() {
+	shutdown := make(chan struct{})
+
+	// Health check co-routine
+	go func() {
+		log.Printf("Starting sandbox health checker")
+		defer log.Printf("Stopping sandbox health checker")
+
+		ticker := time.NewTicker(HEALTH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdown:
+				return
+			case <-ticker.C:
+				for _, sb := range a.sandbox.Probe(HEALTH_TIMEOUT) {
+					groupName := ""
+					if ses := a.sessions.BySandbox(sb.IP); ses != nil {
+						groupName = ses.GroupName
+					}
+					a.publishSandbox(EVENT_SANDBOX_HEALTH, &sb, groupName)
+				}
+
+				// Sandboxes that recovered can be handed to waiting sessions
+				for _, w := range a.workshops.List() {
+					a.assignQueued(w.ID)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(shutdown)
+	}
+}
+
 func (a *Application) startHTTPServer(errC chan error, addr string) func() {
 	srv := &http.Server{
 		Addr:           addr,
@@ -128,6 +366,10 @@ func (a *Application) startHTTPServer(errC chan error, addr string) func() {
 		WriteTimeout:   15 * time.Second,
 		ReadTimeout:    15 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		// Handlers moving files extend the deadlines of their connection
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
+		},
 	}
 
 	// HTTP server co-routine
@@ -165,28 +407,159 @@ func orInt(a string, b int) int {
 	}
 	return b
 }
-func guacdConfigFromSession(config *guac.Config, session *session.Session) *guac.Config {
-	ip := session.Sandbox.IP.To4().String()
-	config.Parameters["hostname"] = ip
+
+// orChannels parses serial channels formatted as "pico:5000,probe:5001"
+func orChannels(a string, b []sandbox.SerialChannel) []sandbox.SerialChannel {
+	if a == "" {
+		return b
+	}
+
+	var channels []sandbox.SerialChannel
+	for _, item := range strings.Split(a, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Printf("Invalid serial channel %q, ignoring %s", item, META_SERIAL_CHANNELS)
+			return b
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Printf("Invalid serial channel %q, ignoring %s", item, META_SERIAL_CHANNELS)
+			return b
+		}
+		channels = append(channels, sandbox.SerialChannel{Name: parts[0], Port: port})
+	}
+	return channels
+}
+
+// connectionDefaults returns the connection of sandboxes that do not announce their own
+func connectionDefaults() sandbox.Connection {
+	return sandbox.Connection{
+		Protocol:       or(os.Getenv("REMOTO_REMOTE_PROTOCOL"), "rdp"),
+		Port:           orInt(os.Getenv("REMOTO_REMOTE_PORT"), 0),
+		Username:       or(os.Getenv("REMOTO_REMOTE_USERNAME"), "workshop"),
+		Password:       or(os.Getenv("REMOTO_REMOTE_PASSWORD"), "workshop"),
+		SerialPort:     orInt(os.Getenv("REMOTO_REMOTE_SERIAL_PORT"), 5000),
+		SerialProtocol: or(os.Getenv("REMOTO_REMOTE_SERIAL_PROTOCOL"), string(serialbroker.ProtocolRaw)),
+		Parameters: map[string]string{
+			"ignore-cert": or(os.Getenv("REMOTO_REMOTE_IGNORE_CERT"), "true"),
+			"security":    or(os.Getenv("REMOTO_REMOTE_SECURITY"), "any"),
+		},
+	}
+}
+
+// connectionFromInstance overrides the connection defaults with the workshop
+// connection and the port and metadata announced by discovery
+func connectionFromInstance(w workshop.Workshop, instance discovery.Instance) sandbox.Connection {
+	conn := connectionDefaults().Merge(w.Connection)
+	meta := instance.Meta
+
+	if instance.Port != 0 {
+		conn.Port = instance.Port
+	}
+	conn.Protocol = or(meta[META_PROTOCOL], conn.Protocol)
+	conn.Port = orInt(meta[META_PORT], conn.Port)
+	conn.Username = or(meta[META_USERNAME], conn.Username)
+	conn.Password = or(meta[META_PASSWORD], conn.Password)
+	conn.SerialPort = orInt(meta[META_SERIAL_PORT], conn.SerialPort)
+	conn.SerialProtocol = or(meta[META_SERIAL_PROTOCOL], conn.SerialProtocol)
+	conn.SerialChannels = orChannels(meta[META_SERIAL_CHANNELS], conn.SerialChannels)
+	conn.Parameters["ignore-cert"] = or(meta[META_IGNORE_CERT], conn.Parameters["ignore-cert"])
+	conn.Parameters["security"] = or(meta[META_SECURITY], conn.Parameters["security"])
+	conn.Terminal = orTerminal(meta, conn.Terminal)
+	conn.Clipboard = orClipboard(meta, conn.Clipboard)
+
+	return conn
+}
+
+// orTerminal applies the terminal settings of the metadata, the terminal is
+// left nil if neither configure it
+func orTerminal(meta map[string]string, t *sandbox.Terminal) *sandbox.Terminal {
+	override := &sandbox.Terminal{
+		PrivateKey:  meta[META_PRIVATE_KEY],
+		Passphrase:  meta[META_PASSPHRASE],
+		HostKey:     meta[META_HOST_KEY],
+		FontName:    meta[META_FONT_NAME],
+		FontSize:    orInt(meta[META_FONT_SIZE], 0),
+		ColorScheme: meta[META_COLOR_SCHEME],
+		Scrollback:  orInt(meta[META_SCROLLBACK], 0),
+		SFTP:        meta[META_SFTP] == "true",
+		SFTPRoot:    meta[META_SFTP_ROOT],
+	}
+	if *override == (sandbox.Terminal{}) {
+		return t
+	}
+	return t.Merge(override)
+}
+
+// orClipboard applies the clipboard policy of the metadata, the policy is
+// left nil if neither configure it
+func orClipboard(meta map[string]string, c *sandbox.Clipboard) *sandbox.Clipboard {
+	override := &sandbox.Clipboard{
+		DisableCopy:  meta[META_DISABLE_COPY] == "true",
+		DisablePaste: meta[META_DISABLE_PASTE] == "true",
+		MaxSize:      orInt(meta[META_CLIPBOARD_SIZE], 0),
+	}
+	if *override == (sandbox.Clipboard{}) {
+		return c
+	}
+	return c.Merge(override)
+}
+
+func guacdConfigFromSandbox(config *guac.Config, sb sandbox.Sandbox) *guac.Config {
+	conn := sb.Connection
+	config.Protocol = conn.Protocol
+	config.Parameters["hostname"] = sb.IP.To4().String()
+	config.Parameters["port"] = strconv.Itoa(conn.RemotePort())
+	config.Parameters["username"] = conn.Username
+	config.Parameters["password"] = conn.Password
+	for key, value := range conn.Parameters {
+		config.Parameters[key] = value
+	}
+	if conn.Protocol == sandbox.ProtocolSSH && conn.Terminal != nil {
+		for key, value := range conn.Terminal.Parameters() {
+			config.Parameters[key] = value
+		}
+	}
 	return config
 }
 
 func guacdConfigDefaults() *guac.Config {
 	config := guac.NewGuacamoleConfiguration()
-	config.Protocol = or(os.Getenv("REMOTO_REMOTE_PROTOCOL"), "rdp")
-	config.Parameters["port"] = or(os.Getenv("REMOTO_REMOTE_PORT"), "3389")
-	config.Parameters["username"] = or(os.Getenv("REMOTO_REMOTE_USERNAME"), "workshop")
-	config.Parameters["password"] = or(os.Getenv("REMOTO_REMOTE_PASSWORD"), "workshop")
-	config.Parameters["ignore-cert"] = or(os.Getenv("REMOTO_REMOTE_IGNORE_CERT"), "true")
-	config.Parameters["security"] = or(os.Getenv("REMOTO_REMOTE_SECURITY"), "any")
+	config = guacdConfigFromSandbox(config, sandbox.Sandbox{Connection: connectionDefaults()})
+	delete(config.Parameters, "hostname")
 	config.OptimalScreenWidth = orInt(os.Getenv("REMOTO_REMOTE_WIDTH"), 1366)
 	config.OptimalScreenHeight = orInt(os.Getenv("REMOTO_REMOTE_HEIGHT"), 768)
 	// config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
 	return config
 }
 
+// sandboxConnection returns the connection of a sandbox, or the defaults if it is unknown
+func (a *Application) sandboxConnection(ip net.IP) sandbox.Connection {
+	conn := connectionDefaults()
+	if sb, err := a.sandbox.Get(ip); err == nil {
+		conn = conn.Merge(sb.Connection)
+	}
+	return conn
+}
+
+// sandboxSerialAgent returns how to reach the serial agent of a sandbox channel
+func (a *Application) sandboxSerialAgent(ip net.IP, channel string) (serialbroker.Agent, error) {
+	// Admins can tunnel to hosts outside the sandbox pools within the allowed networks
+	if _, err := a.sandbox.Get(ip); err != nil && !a.connections.allowsNetwork(ip) {
+		return serialbroker.Agent{}, ErrHostNotAllowed
+	}
+	conn := a.sandboxConnection(ip)
+	ch, ok := conn.Channel(channel)
+	if !ok {
+		return serialbroker.Agent{}, serialbroker.ErrUnknownChannel
+	}
+	return serialbroker.Agent{
+		Port:     ch.Port,
+		Protocol: serialbroker.Protocol(conn.SerialProtocol),
+	}, nil
+}
+
 func (a *Application) onGuacConnect(r *http.Request) (guac.Tunnel, error) {
-	var err error
 	log.Printf("Guac WS connection...\n")
 
 	// Get ses sandbox
@@ -196,62 +569,139 @@ func (a *Application) onGuacConnect(r *http.Request) (guac.Tunnel, error) {
 	}
 
 	config := guacdConfigDefaults()
+	// Clipboard policy of the sandbox, admins are not restricted
+	var clip *sandbox.Clipboard
 
-	// As admin we can arbitary choose a sandbox with settings
+	// Admins open the connection they requested with httpCreateConnection
 	if ses.IsAdmin {
-		q := r.URL.Query()
-		config.Protocol = or(q.Get("protocol"), config.Protocol)
-		config.Parameters["hostname"] = or(q.Get("hostname"), config.Parameters["hostname"])
-		config.Parameters["port"] = or(q.Get("port"), config.Parameters["port"])
-		config.Parameters["username"] = or(q.Get("username"), config.Parameters["username"])
-		config.Parameters["password"] = or(q.Get("password"), config.Parameters["password"])
-		config.Parameters["ignore-cert"] = or(q.Get("ignorecert"), config.Parameters["ignore-cert"])
-		config.Parameters["security"] = or(q.Get("security"), config.Parameters["security"])
+		var err error
+		config, err = a.connectionTokens.Take(ses.ID, r.URL.Query().Get("token"))
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		config = guacdConfigFromSession(config, ses)
+		if ses.Sandbox == nil {
+			return nil, errors.New("cannot start guacamole tunnel without sandbox")
+		}
+		sb, err := a.sandbox.Get(ses.Sandbox.IP)
+		if err != nil {
+			return nil, err
+		}
+		config = guacdConfigFromSandbox(config, sb)
+		if a.transferEnabled(ses.WorkshopID) {
+			a.guacdTransferConfig(config, sb, ses.ID)
+		}
+		if clip = sb.Connection.Clipboard; clip != nil {
+			for key, value := range clip.Parameters() {
+				config.Parameters[key] = value
+			}
+		}
 	}
 
-	// Get GuacD IP
-	guacdIP := a.discovery.Get(DISCOVERY_GUACD)
-	if len(guacdIP) == 0 {
-		return nil, errors.New("cannot start guacamole tunnel without guacd ip")
+	tunnel, guacd, err := a.dialGuacdPool(config)
+	if err != nil {
+		return nil, err
 	}
+	log.Printf("Connected session (%s) to sandbox (%s) through guacd at (%s)\n", ses.GroupName, config.Parameters["hostname"], guacdAddr(guacd))
 
-	log.Printf("Connecting session (%s) to sandbox (%s) through guacd at (%s)\n", ses.GroupName, config.Parameters["hostname"], guacdIP[0])
+	// Enforce the clipboard policy on the instructions as well
+	if clip != nil {
+		tunnel = clipboard.WrapTunnel(tunnel, *clip)
+	}
 
-	// Connect to GuacD
-	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: guacdIP[0], Port: 4822})
-	if err != nil {
-		fmt.Println("error while connecting to guacd", err)
-		return nil, err
+	// Record the connection so admins can join it
+	if !ses.IsAdmin {
+		a.tunnels.Add(ses.ID, tunnel.ConnectionID(), guacd)
 	}
 
-	// Create tunnel
-	stream := guac.NewStream(conn, guac.SocketTimeout)
+	if !ses.IsAdmin && a.recordingEnabled(ses.WorkshopID) {
+		writer, err := a.recordings.Start(ses.WorkshopID, ses.ID, ses.GroupName)
+		if err != nil {
+			log.Printf("Could not start recording for session (%s): %v\n", ses.GroupName, err)
+			return tunnel, nil
+		}
+		return recording.WrapTunnel(tunnel, writer), nil
+	}
 
-	// // Set ID
-	// config.ConnectionID = session.ID
+	return tunnel, nil
+}
 
-	err = stream.Handshake(config)
-	if err != nil {
-		return nil, err
+// recordingEnabled returns true if sessions of the workshop should be recorded
+func (a *Application) recordingEnabled(workshopID string) bool {
+	if a.recordings == nil {
+		return false
 	}
+	w, err := a.workshops.Get(workshopID)
+	return err == nil && w.Record
+}
 
-	return guac.NewSimpleTunnel(stream), nil
+// sandboxWorkshop returns the workshop of a sandbox discovery service
+func (a *Application) sandboxWorkshop(svc string) (workshop.Workshop, bool) {
+	if !strings.HasPrefix(svc, DISCOVERY_SANDBOX) {
+		return workshop.Workshop{}, false
+	}
+	w, err := a.workshops.Get(strings.TrimPrefix(svc, DISCOVERY_SANDBOX))
+	return w, err == nil
 }
 
-func (a *Application) onServiceDiscovered(svc string, ip net.IP) {
-	log.Printf("Service discovered: %s -> %s", svc, ip.String())
-	if svc == DISCOVERY_GUACD {
+func (a *Application) onServiceDiscovered(svc string, instance discovery.Instance) {
+	log.Printf("Service discovered: %s -> %s", svc, instance.IP.String())
+	w, ok := a.sandboxWorkshop(svc)
+	if !ok {
+		return
+	}
+	ip := instance.IP
+	sandbox := a.sandbox.Add(ip, w.ID, connectionFromInstance(w, instance))
+
+	// Sandboxes that were lost while reserved stay with their session, those
+	// reserved before a restart are bound to the session that held them
+	if sandbox.Reserved {
+		groupName := ""
+		if ses := a.sessions.BySandbox(ip); ses != nil {
+			log.Printf("Sandbox %s of session %s is back", ip.String(), ses.GroupName)
+			groupName = ses.GroupName
+		} else if ses := a.sessions.BindRestored(sandbox); ses != nil {
+			log.Printf("Restored sandbox %s to session %s", ip.String(), ses.GroupName)
+			groupName = ses.GroupName
+			a.publishSession(EVENT_SESSION_UPDATED, ses)
+		} else if a.reclaims.Holds(ip) {
+			log.Printf("Sandbox %s is kept for its group to reclaim", ip.String())
+		} else {
+			// Nobody claims the reservation, the sandbox is free again
+			log.Printf("Releasing unclaimed reservation of sandbox %s", ip.String())
+			a.publishSandbox(EVENT_SANDBOX_DISCOVERED, sandbox, "")
+			a.releaseSandbox(sandbox)
+			return
+		}
+		a.publishSandbox(EVENT_SANDBOX_DISCOVERED, sandbox, groupName)
 		return
 	}
-	a.sandbox.Add(ip)
+	a.publishSandbox(EVENT_SANDBOX_DISCOVERED, sandbox, "")
+
+	// Hand the new sandbox to a waiting session
+	a.assignQueued(w.ID)
 }
 
-func (a *Application) onServiceLost(svc string, ip net.IP) {
-	log.Printf("Service lost: %s -> %s", svc, ip.String())
+func (a *Application) onServiceUpdated(svc string, instance discovery.Instance) {
+	log.Printf("Service updated: %s -> %s", svc, instance.IP.String())
+	w, ok := a.sandboxWorkshop(svc)
+	if !ok {
+		return
+	}
+	a.sandbox.Update(instance.IP, connectionFromInstance(w, instance))
+}
+
+func (a *Application) onServiceLost(svc string, instance discovery.Instance) {
+	log.Printf("Service lost: %s -> %s", svc, instance.IP.String())
 	if svc == DISCOVERY_GUACD {
+		a.guacds.forget(instance)
+		return
+	}
+	w, ok := a.sandboxWorkshop(svc)
+	if !ok {
 		return
 	}
-	a.sandbox.Delete(ip)
+	a.sandbox.Delete(instance.IP)
+	a.agents.Delete(instance.IP)
+	a.publishSandbox(EVENT_SANDBOX_LOST, &sandbox.Sandbox{IP: instance.IP, Workshop: w.ID}, "")
 }
@@ -0,0 +1,288 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/session"
+	"remoto.senwize.com/internal/transfer"
+)
+
+var (
+	ErrTransferDisabled    = errors.New("file transfer is disabled for this workshop")
+	ErrTransferUnsupported = errors.New("file transfer is only supported for RDP sandboxes")
+
+	// Name of the drive RDP sandboxes see the transfer directory as
+	TRANSFER_DRIVE_NAME = "Remoto"
+	// Bytes every session may store in its transfer directory if not configured
+	TRANSFER_DEFAULT_QUOTA int64 = 100 * 1024 * 1024
+)
+
+type transferFileDTO struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+func transferFileToDTO(f transfer.File) transferFileDTO {
+	return transferFileDTO{
+		Name:    f.Name,
+		Size:    f.Size,
+		ModTime: f.ModTime.Unix(),
+	}
+}
+
+// transferEnabled returns true if groups of the workshop can transfer files
+func (a *Application) transferEnabled(workshopID string) bool {
+	w, err := a.workshops.Get(workshopID)
+	return err == nil && w.FileTransfer
+}
+
+// transferSupported returns true if the sandbox of a session sees the transfer
+// directory, guacd only redirects it into RDP sandboxes
+func (a *Application) transferSupported(ses *session.Session) bool {
+	return ses.Sandbox != nil && a.sandboxConnection(ses.Sandbox.IP).Protocol == "rdp"
+}
+
+// guacdTransferConfig enables file transfer on the connection of a session.
+// RDP sandboxes get the transfer directory of the session as a drive, VNC
+// and ssh sandboxes transfer files over SFTP.
+func (a *Application) guacdTransferConfig(config *guac.Config, sb sandbox.Sandbox, sessionID string) {
+	switch config.Protocol {
+	case "rdp":
+		if a.transfers == nil {
+			log.Printf("Cannot redirect a drive to sandbox (%s) without a transfer directory\n", sb.IP)
+			return
+		}
+		if _, err := a.transfers.Prepare(sessionID); err != nil {
+			log.Printf("Could not create transfer directory for sandbox (%s): %v\n", sb.IP, err)
+			return
+		}
+		config.Parameters["enable-drive"] = "true"
+		config.Parameters["drive-name"] = TRANSFER_DRIVE_NAME
+		config.Parameters["drive-path"] = filepath.Join(a.guacdTransferDir, transfer.Dir(sessionID))
+	case "vnc":
+		config.Parameters["enable-sftp"] = "true"
+		config.Parameters["sftp-hostname"] = config.Parameters["hostname"]
+		config.Parameters["sftp-username"] = config.Parameters["username"]
+		config.Parameters["sftp-password"] = config.Parameters["password"]
+		if t := sb.Connection.Terminal; t != nil {
+			config.Parameters["sftp-private-key"] = t.PrivateKey
+			config.Parameters["sftp-passphrase"] = t.Passphrase
+		}
+	case sandbox.ProtocolSSH:
+		config.Parameters["enable-sftp"] = "true"
+	}
+}
+
+// forgetTransfers removes the files of a session that ended
+func (a *Application) forgetTransfers(sessionID string) {
+	if a.transfers == nil {
+		return
+	}
+	if err := a.transfers.Forget(sessionID); err != nil {
+		log.Printf("Could not remove transfer directory of session (%s): %v\n", sessionID, err)
+	}
+}
+
+// transferSession returns the session of a request if its workshop has file
+// transfer enabled and its sandbox supports it, responding with an error otherwise
+func (a *Application) transferSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	ses := session.Get(r.Context())
+	if a.transfers == nil || ses.IsAdmin || !a.transferEnabled(ses.WorkshopID) {
+		httpErrorStatus(w, http.StatusNotFound, ErrTransferDisabled)
+		return nil, false
+	}
+	if !a.transferSupported(ses) {
+		httpErrorStatus(w, http.StatusNotFound, ErrTransferUnsupported)
+		return nil, false
+	}
+	return ses, true
+}
+
+// httpListTransfers lists the transfer directory of the session and its usage
+func (a *Application) httpListTransfers() http.HandlerFunc {
+	type responseDTO struct {
+		Files []transferFileDTO `json:"files"`
+		Usage int64             `json:"usage"`
+		Quota int64             `json:"quota"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses, ok := a.transferSession(w, r)
+		if !ok {
+			return
+		}
+
+		files, err := a.transfers.List(ses.ID)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		res := responseDTO{Files: make([]transferFileDTO, 0, len(files)), Quota: a.transfers.Quota()}
+		for _, f := range files {
+			res.Files = append(res.Files, transferFileToDTO(f))
+			res.Usage += f.Size
+		}
+		httpResponse(w, http.StatusOK, res)
+	}
+}
+
+// httpUploadTransfer stores the body in the transfer directory of the session
+// as the name query parameter
+func (a *Application) httpUploadTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses, ok := a.transferSession(w, r)
+		if !ok {
+			return
+		}
+
+		if r.ContentLength > a.transfers.Quota() {
+			httpErrorStatus(w, http.StatusRequestEntityTooLarge, transfer.ErrQuotaExceeded)
+			return
+		}
+		f, err := a.transfers.Save(ses.ID, r.URL.Query().Get("name"), r.Body)
+		if !httpTransferError(w, err) {
+			return
+		}
+		httpResponse(w, http.StatusCreated, transferFileToDTO(f))
+	}
+}
+
+// httpDownloadTransfer serves a file of the transfer directory of the session
+func (a *Application) httpDownloadTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses, ok := a.transferSession(w, r)
+		if !ok {
+			return
+		}
+
+		name := chi.URLParam(r, "name")
+		f, err := a.transfers.Open(ses.ID, name)
+		if !httpTransferError(w, err) {
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, name, info.ModTime(), f)
+	}
+}
+
+// httpDeleteTransfer removes a file from the transfer directory of the session
+func (a *Application) httpDeleteTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ses, ok := a.transferSession(w, r)
+		if !ok {
+			return
+		}
+
+		err := a.transfers.Delete(ses.ID, chi.URLParam(r, "name"))
+		if !httpTransferError(w, err) {
+			return
+		}
+		httpResponse(w, http.StatusOK, map[string]string{"message": "Deleted"})
+	}
+}
+
+// httpPushHandout copies the body, named by the name query parameter, to the
+// transfer directory of every group the admin administers. The workshop
+// query parameter limits the groups to a workshop.
+func (a *Application) httpPushHandout() http.HandlerFunc {
+	type responseDTO struct {
+		Name      string            `json:"name"`
+		Size      int64             `json:"size"`
+		Delivered []string          `json:"delivered"`
+		Failed    map[string]string `json:"failed"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.transfers == nil {
+			httpErrorStatus(w, http.StatusNotFound, ErrTransferDisabled)
+			return
+		}
+		current := session.Get(r.Context())
+		workshopID := adminWorkshopFilter(r)
+		name := r.URL.Query().Get("name")
+		if !transfer.ValidName(name) {
+			httpErrorStatus(w, http.StatusBadRequest, fmt.Errorf("%w: %q", transfer.ErrInvalidName, name))
+			return
+		}
+
+		// Keep the handout aside, it is copied once per group
+		tmp, err := os.CreateTemp("", "remoto-handout-*")
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err := io.Copy(tmp, io.LimitReader(r.Body, a.transfers.Quota()+1))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if size > a.transfers.Quota() {
+			httpErrorStatus(w, http.StatusRequestEntityTooLarge, transfer.ErrQuotaExceeded)
+			return
+		}
+
+		res := responseDTO{Name: name, Size: size, Delivered: []string{}, Failed: map[string]string{}}
+		for _, ses := range a.sessions.List() {
+			if ses.IsAdmin || !current.CanAdminister(ses.WorkshopID) || (workshopID != "" && ses.WorkshopID != workshopID) {
+				continue
+			}
+			if !a.transferEnabled(ses.WorkshopID) {
+				continue
+			}
+			if !a.transferSupported(&ses) {
+				res.Failed[ses.GroupName] = ErrTransferUnsupported.Error()
+				continue
+			}
+
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				httpError(w, err)
+				return
+			}
+			if _, err := a.transfers.Save(ses.ID, name, tmp); err != nil {
+				res.Failed[ses.GroupName] = err.Error()
+				continue
+			}
+			res.Delivered = append(res.Delivered, ses.GroupName)
+		}
+
+		log.Printf("Admin (%s) pushed handout %s to %d groups, %d failed\n", current.GroupName, name, len(res.Delivered), len(res.Failed))
+		httpResponse(w, http.StatusOK, res)
+	}
+}
+
+// httpTransferError responds to transfer errors, it returns true if there was none
+func httpTransferError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, transfer.ErrNotFound):
+		httpErrorStatus(w, http.StatusNotFound, err)
+	case errors.Is(err, transfer.ErrInvalidName):
+		httpErrorStatus(w, http.StatusBadRequest, err)
+	case errors.Is(err, transfer.ErrQuotaExceeded):
+		httpErrorStatus(w, http.StatusRequestEntityTooLarge, err)
+	default:
+		httpError(w, err)
+	}
+	return false
+}
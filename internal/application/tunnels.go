@@ -0,0 +1,147 @@
+package application
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/discovery"
+	"remoto.senwize.com/internal/session"
+)
+
+var (
+	ErrNoActiveTunnel = errors.New("session has no active remote desktop")
+)
+
+// activeTunnel is the guacd connection of a group's remote desktop
+type activeTunnel struct {
+	ConnectionID string
+	Guacd        discovery.Instance
+	Since        time.Time
+	// Watchers is the number of admins shadowing the connection
+	Watchers int
+}
+
+// tunnelRegistry keeps the active guacd connection of every session
+type tunnelRegistry struct {
+	lock      sync.Locker
+	bySession map[string]*activeTunnel
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{
+		lock:      &sync.Mutex{},
+		bySession: map[string]*activeTunnel{},
+	}
+}
+
+// Add registers the tunnel of a session. Admins shadowing the tunnel it
+// replaces are still counted, they leave through Watch.
+func (t *tunnelRegistry) Add(sessionID, connectionID string, guacd discovery.Instance) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	watchers := 0
+	if previous, ok := t.bySession[sessionID]; ok {
+		watchers = previous.Watchers
+	}
+	t.bySession[sessionID] = &activeTunnel{
+		ConnectionID: connectionID,
+		Guacd:        guacd,
+		Since:        time.Now(),
+		Watchers:     watchers,
+	}
+}
+
+// Remove forgets the tunnel of a session if it is still the given connection
+func (t *tunnelRegistry) Remove(sessionID, connectionID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if tunnel, ok := t.bySession[sessionID]; ok && tunnel.ConnectionID == connectionID {
+		delete(t.bySession, sessionID)
+	}
+}
+
+func (t *tunnelRegistry) Get(sessionID string) (activeTunnel, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tunnel, ok := t.bySession[sessionID]
+	if !ok {
+		return activeTunnel{}, false
+	}
+	return *tunnel, true
+}
+
+// Watch changes the number of admins shadowing the tunnel of a session
+func (t *tunnelRegistry) Watch(sessionID string, delta int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if tunnel, ok := t.bySession[sessionID]; ok {
+		tunnel.Watchers += delta
+		if tunnel.Watchers < 0 {
+			tunnel.Watchers = 0
+		}
+	}
+}
+
+// Watched returns true if an admin is shadowing the tunnel of a session
+func (t *tunnelRegistry) Watched(sessionID string) bool {
+	tunnel, ok := t.Get(sessionID)
+	return ok && tunnel.Watchers > 0
+}
+
+// onGuacShadow joins the active guacd connection of a session, read-only
+// unless the admin asks for control
+func (a *Application) onGuacShadow(r *http.Request) (guac.Tunnel, error) {
+	admin := session.Get(r.Context())
+	sessionID := chi.URLParam(r, "sessionID")
+
+	target := a.sessions.Get(sessionID)
+	if target == nil {
+		return nil, ErrSessionNotFound
+	}
+	if !admin.CanAdminister(target.WorkshopID) {
+		return nil, ErrForbidden
+	}
+
+	active, ok := a.tunnels.Get(sessionID)
+	if !ok {
+		return nil, ErrNoActiveTunnel
+	}
+
+	config := guacdConfigDefaults()
+	config.ConnectionID = active.ConnectionID
+	config.Parameters["read-only"] = "true"
+	if r.URL.Query().Get("control") == "true" {
+		config.Parameters["read-only"] = ""
+	}
+
+	log.Printf("Admin (%s) shadowing session (%s) read-only=%s\n", admin.GroupName, target.GroupName, config.Parameters["read-only"])
+
+	stream, err := dialGuacd(active.Guacd, config)
+	if err != nil {
+		a.guacds.failed(guacdAddr(active.Guacd), err)
+		return nil, err
+	}
+
+	return a.guacdTunnel(active.Guacd, stream), nil
+}
+
+func (a *Application) onShadowConnect(id string, r *http.Request) {
+	sessionID := chi.URLParam(r, "sessionID")
+	a.tunnels.Watch(sessionID, 1)
+	a.publishSessionByID(EVENT_SESSION_UPDATED, sessionID)
+}
+
+func (a *Application) onShadowDisconnect(id string, r *http.Request, tunnel guac.Tunnel) {
+	sessionID := chi.URLParam(r, "sessionID")
+	a.tunnels.Watch(sessionID, -1)
+	a.publishSessionByID(EVENT_SESSION_UPDATED, sessionID)
+}
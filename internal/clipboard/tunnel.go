@@ -0,0 +1,282 @@
+package clipboard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/wwt/guac"
+	"remoto.senwize.com/internal/sandbox"
+)
+
+/*
+	The clipboard filter enforces the clipboard policy of a sandbox on the
+	instructions passing through the guacamole tunnel. guacd is told the same
+	policy with disable-copy and disable-paste, the filter also holds if guacd
+	ignores them and caps the size of the clipboard.
+
+	A clipboard is a stream: a clipboard instruction opens it, blob instructions
+	carry the base64 encoded data and an end instruction closes it. With a size
+	cap, the stream is held back until it ends, so a clipboard is either passed
+	whole or dropped whole.
+*/
+
+var (
+	ErrMalformed = errors.New("malformed instruction")
+
+	// Clipboard streams held back at once per direction, further streams are dropped
+	MAX_PENDING_STREAMS = 8
+
+	opClipboard = []byte("9.clipboard,")
+	opBlob      = []byte("4.blob,")
+	opEnd       = []byte("3.end,")
+
+	// nop replaces dropped instructions towards the browser
+	nop = guac.NewInstruction("nop").Byte()
+)
+
+// Tunnel filters the clipboard instructions of the wrapped tunnel
+type Tunnel struct {
+	guac.Tunnel
+	copy  *filter
+	paste *filter
+}
+
+// WrapTunnel applies the clipboard policy to the tunnel
+func WrapTunnel(tunnel guac.Tunnel, policy sandbox.Clipboard) *Tunnel {
+	return &Tunnel{
+		Tunnel: tunnel,
+		copy:   newFilter("copy", policy.DisableCopy, policy.MaxSize),
+		paste:  newFilter("paste", policy.DisablePaste, policy.MaxSize),
+	}
+}
+
+// AcquireReader filters the clipboard copied from the sandbox
+func (t *Tunnel) AcquireReader() guac.InstructionReader {
+	return &reader{
+		InstructionReader: t.Tunnel.AcquireReader(),
+		filter:            t.copy,
+	}
+}
+
+// AcquireWriter filters the clipboard pasted into the sandbox
+func (t *Tunnel) AcquireWriter() io.Writer {
+	return &writer{
+		Writer: t.Tunnel.AcquireWriter(),
+		filter: t.paste,
+	}
+}
+
+type reader struct {
+	guac.InstructionReader
+	filter *filter
+}
+
+func (r *reader) ReadSome() ([]byte, error) {
+	ins, err := r.InstructionReader.ReadSome()
+	if err != nil || !r.filter.matches(ins) {
+		return ins, err
+	}
+
+	elements, _, err := next(ins)
+	if err != nil {
+		return ins, nil
+	}
+	if out := r.filter.apply(ins, elements); out != nil {
+		return out, nil
+	}
+	// The browser needs an instruction to flush what it was sent before
+	return nop, nil
+}
+
+type writer struct {
+	io.Writer
+	filter *filter
+}
+
+// Write passes the instructions of a websocket message to guacd, without the
+// filtered ones
+func (w *writer) Write(data []byte) (int, error) {
+	if !w.filter.active() && !bytes.Contains(data, opClipboard) {
+		return w.Writer.Write(data)
+	}
+
+	var out []byte
+	for rest := data; len(rest) > 0; {
+		elements, n, err := next(rest)
+		if err != nil {
+			log.Printf("[Clipboard] Dropping %d bytes from browser: %v", len(rest), err)
+			break
+		}
+		ins := rest[:n]
+		rest = rest[n:]
+		if !w.filter.matches(ins) {
+			out = append(out, ins...)
+			continue
+		}
+		out = append(out, w.filter.apply(ins, elements)...)
+	}
+
+	if len(out) > 0 {
+		if _, err := w.Writer.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// filter drops or holds back the clipboard streams in one direction
+type filter struct {
+	direction string
+	disabled  bool
+	maxSize   int
+	// streams are the clipboard streams in progress by stream index
+	streams map[string]*stream
+}
+
+type stream struct {
+	held    [][]byte
+	size    int
+	dropped bool
+}
+
+func newFilter(direction string, disabled bool, maxSize int) *filter {
+	return &filter{
+		direction: direction,
+		disabled:  disabled,
+		maxSize:   maxSize,
+		streams:   map[string]*stream{},
+	}
+}
+
+// active returns true if clipboard streams are in progress
+func (f *filter) active() bool {
+	return len(f.streams) > 0
+}
+
+// matches returns true if the instruction may belong to a clipboard stream
+func (f *filter) matches(ins []byte) bool {
+	if bytes.HasPrefix(ins, opClipboard) {
+		return true
+	}
+	return f.active() && (bytes.HasPrefix(ins, opBlob) || bytes.HasPrefix(ins, opEnd))
+}
+
+// apply returns the instructions to pass on for an instruction, nil if it
+// is dropped or held back
+func (f *filter) apply(ins []byte, elements []string) []byte {
+	if len(elements) < 2 {
+		return ins
+	}
+	opcode, index := elements[0], elements[1]
+
+	switch opcode {
+	case "clipboard":
+		if f.disabled {
+			log.Printf("[Clipboard] Dropping %s, disabled by the workshop", f.direction)
+			f.streams[index] = &stream{dropped: true}
+			return nil
+		}
+		if f.maxSize == 0 {
+			return ins
+		}
+		if len(f.streams) >= MAX_PENDING_STREAMS {
+			log.Printf("[Clipboard] Dropping %s, too many clipboards in progress", f.direction)
+			return nil
+		}
+		f.streams[index] = &stream{held: [][]byte{clone(ins)}}
+		return nil
+
+	case "blob":
+		s, ok := f.streams[index]
+		if !ok {
+			return ins
+		}
+		if s.dropped {
+			return nil
+		}
+		if len(elements) > 2 {
+			s.size += decodedLen(elements[2])
+		}
+		if s.size > f.maxSize {
+			log.Printf("[Clipboard] Dropping %s, exceeds %d bytes", f.direction, f.maxSize)
+			s.dropped = true
+			s.held = nil
+			return nil
+		}
+		s.held = append(s.held, clone(ins))
+		return nil
+
+	case "end":
+		s, ok := f.streams[index]
+		if !ok {
+			return ins
+		}
+		delete(f.streams, index)
+		if s.dropped {
+			return nil
+		}
+		return bytes.Join(append(s.held, ins), nil)
+	}
+	return ins
+}
+
+// next splits the first instruction off data, it returns the elements of the
+// instruction and its length in bytes. Element lengths count characters.
+func next(data []byte) ([]string, int, error) {
+	var elements []string
+	i := 0
+	for {
+		start := i
+		for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+			i++
+		}
+		if i == start || i >= len(data) || data[i] != '.' {
+			return nil, 0, ErrMalformed
+		}
+		length, err := strconv.Atoi(string(data[start:i]))
+		if err != nil {
+			return nil, 0, ErrMalformed
+		}
+		i++
+
+		valueStart := i
+		for c := 0; c < length; c++ {
+			if i >= len(data) {
+				return nil, 0, ErrMalformed
+			}
+			_, size := utf8.DecodeRune(data[i:])
+			i += size
+		}
+		elements = append(elements, string(data[valueStart:i]))
+
+		if i >= len(data) {
+			return nil, 0, ErrMalformed
+		}
+		switch data[i] {
+		case ';':
+			return elements, i + 1, nil
+		case ',':
+			i++
+		default:
+			return nil, 0, ErrMalformed
+		}
+	}
+}
+
+// decodedLen returns the number of bytes base64 data decodes to
+func decodedLen(data string) int {
+	n := len(data) / 4 * 3
+	for i := len(data) - 1; i >= 0 && data[i] == '='; i-- {
+		n--
+	}
+	return n
+}
+
+// clone copies an instruction, the reader reuses its buffer
+func clone(ins []byte) []byte {
+	return append([]byte(nil), ins...)
+}
@@ -0,0 +1,63 @@
+package discovery
+
+import "net"
+
+// Instance is a discovered instance of a service, instances are identified
+// by their IP
+type Instance struct {
+	IP net.IP
+	// Port is the port announced by the provider, 0 if the provider has none
+	Port int
+	// Meta holds provider specific metadata, such as connection settings
+	Meta map[string]string
+}
+
+// Changed returns true if the port or metadata differ
+func (i Instance) Changed(other Instance) bool {
+	if i.Port != other.Port || len(i.Meta) != len(other.Meta) {
+		return true
+	}
+	for key, value := range i.Meta {
+		if v, ok := other.Meta[key]; !ok || v != value {
+			return true
+		}
+	}
+	return false
+}
+
+type instanceList []Instance
+
+func (l instanceList) Get(ip net.IP) (Instance, bool) {
+	for _, i := range l {
+		if i.IP.Equal(ip) {
+			return i, true
+		}
+	}
+	return Instance{}, false
+}
+
+func (l instanceList) Contains(instance Instance) bool {
+	_, ok := l.Get(instance.IP)
+	return ok
+}
+
+func (l instanceList) Subtract(other instanceList) instanceList {
+	var result instanceList
+	for _, instance := range l {
+		if !other.Contains(instance) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// Changed returns the instances in l that exist in other with a different port or metadata
+func (l instanceList) Changed(other instanceList) instanceList {
+	var result instanceList
+	for _, instance := range l {
+		if previous, ok := other.Get(instance.IP); ok && instance.Changed(previous) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownScheme = errors.New("unknown discovery scheme")
+
+	HTTP_TIMEOUT = 5 * time.Second
+)
+
+// Provider finds the instances of a service
+type Provider interface {
+	Lookup() ([]Instance, error)
+}
+
+// ParseProvider creates a provider from a source string. Supported sources are:
+//
+//	guacd.remoto.local                     DNS A records (default)
+//	dns://guacd.remoto.local               DNS A records
+//	srv://_rdp._tcp.sandbox.remoto.local   DNS SRV records
+//	file:///etc/remoto/sandboxes.json      Static inventory file
+//	http://inventory.local/sandboxes       HTTP JSON endpoint
+func ParseProvider(source string) (Provider, error) {
+	if !strings.Contains(source, "://") {
+		return &DNSProvider{FQDN: source}, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery source %q: %w", source, err)
+	}
+
+	switch u.Scheme {
+	case "dns":
+		return &DNSProvider{FQDN: u.Host}, nil
+	case "srv":
+		return &SRVProvider{Name: u.Host}, nil
+	case "file":
+		return NewFileProvider(u.Path), nil
+	case "http", "https":
+		return &HTTPProvider{URL: source}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, u.Scheme)
+}
+
+// DNSProvider finds instances through DNS A records
+type DNSProvider struct {
+	FQDN string
+}
+
+func (p *DNSProvider) Lookup() ([]Instance, error) {
+	ips, err := lookupIPv4(p.FQDN)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, len(ips))
+	for ix, ip := range ips {
+		instances[ix] = Instance{IP: ip}
+	}
+	return instances, nil
+}
+
+// SRVProvider finds instances and their ports through DNS SRV records
+type SRVProvider struct {
+	Name string
+}
+
+func (p *SRVProvider) Lookup() ([]Instance, error) {
+	_, records, err := net.LookupSRV("", "", p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, record := range records {
+		ips, err := lookupIPv4(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			instances = append(instances, Instance{IP: ip, Port: int(record.Port)})
+		}
+	}
+	return instances, nil
+}
+
+// FileProvider reads instances from a JSON inventory file. The file is
+// reread whenever it changes.
+type FileProvider struct {
+	path string
+
+	cacheLock sync.Locker
+	modTime   time.Time
+	instances []Instance
+}
+
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{
+		path:      path,
+		cacheLock: &sync.Mutex{},
+	}
+}
+
+func (p *FileProvider) Lookup() ([]Instance, error) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unchanged since last read
+	if info.ModTime().Equal(p.modTime) {
+		return p.instances, nil
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	instances, err := decodeInventory(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inventory file %s: %w", p.path, err)
+	}
+
+	p.modTime = info.ModTime()
+	p.instances = instances
+	return instances, nil
+}
+
+// HTTPProvider fetches instances from an HTTP endpoint returning a JSON inventory
+type HTTPProvider struct {
+	URL string
+}
+
+func (p *HTTPProvider) Lookup() ([]Instance, error) {
+	client := &http.Client{Timeout: HTTP_TIMEOUT}
+	res, err := client.Get(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory endpoint %s returned %s", p.URL, res.Status)
+	}
+
+	return decodeInventory(res.Body)
+}
+
+// inventoryEntry is a single instance in a JSON inventory
+type inventoryEntry struct {
+	IP   string            `json:"ip"`
+	Port int               `json:"port,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+func decodeInventory(r io.Reader) ([]Instance, error) {
+	var entries []inventoryEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(entries))
+	for _, entry := range entries {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 address %q", entry.IP)
+		}
+		instances = append(instances, Instance{IP: ip, Port: entry.Port, Meta: entry.Meta})
+	}
+	return instances, nil
+}
+
+func lookupIPv4(host string) ([]net.IP, error) {
+	foundIPs, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filter IPV4
+	var ips = make([]net.IP, 0, len(foundIPs))
+	for _, ip := range foundIPs {
+		if ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
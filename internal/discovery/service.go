@@ -2,87 +2,97 @@ package discovery
 
 import (
 	"log"
-	"net"
 	"sync"
 )
 
 // Service ...
 type Service struct {
-	svcLock   sync.Locker
-	ipMap     map[string]ipList
-	domainMap map[string]string
+	svcLock     sync.Locker
+	instanceMap map[string]instanceList
+	providerMap map[string]Provider
 
-	OnDiscover func(domain string, ip net.IP)
-	OnLost     func(domain string, ip net.IP)
+	OnDiscover func(svc string, instance Instance)
+	OnUpdate   func(svc string, instance Instance)
+	OnLost     func(svc string, instance Instance)
 }
 
 func New() *Service {
 	return &Service{
-		svcLock:   &sync.Mutex{},
-		ipMap:     make(map[string]ipList),
-		domainMap: make(map[string]string),
+		svcLock:     &sync.Mutex{},
+		instanceMap: make(map[string]instanceList),
+		providerMap: make(map[string]Provider),
 	}
 }
 
-func (s *Service) Add(svc, domain string) {
+func (s *Service) Add(svc string, provider Provider) {
 	s.svcLock.Lock()
 	defer s.svcLock.Unlock()
 
-	if _, exists := s.domainMap[svc]; exists {
+	if _, exists := s.providerMap[svc]; exists {
 		return
 	}
 
-	// Register svc to domain
-	s.domainMap[svc] = domain
-	s.ipMap[svc] = ipList{}
+	// Register svc to provider
+	s.providerMap[svc] = provider
+	s.instanceMap[svc] = instanceList{}
 }
 
+// Refresh looks up the instances of every service and calls the listeners
+// for the changes. Lookups can be slow, they are done without holding the lock.
 func (s *Service) Refresh() {
 	s.svcLock.Lock()
-	defer s.svcLock.Unlock()
+	providers := make(map[string]Provider, len(s.providerMap))
+	for svc, provider := range s.providerMap {
+		providers[svc] = provider
+	}
+	s.svcLock.Unlock()
 
-	for svc := range s.ipMap {
-		// Find IPs for this Domain
-		domain := s.domainMap[svc]
-		foundIPs, err := net.LookupIP(domain)
+	// Find instances for every service
+	lookups := make(map[string]instanceList, len(providers))
+	for svc, provider := range providers {
+		found, err := provider.Lookup()
 		if err != nil {
 			log.Printf("Error while refreshing service: %s", err)
 			continue
 		}
+		lookups[svc] = instanceList(found)
+	}
 
-		// Filter IPV4
-		var ips = make(ipList, 0, len(foundIPs))
-		for _, ip := range foundIPs {
-			if ip.To4() != nil {
-				ips = append(ips, ip)
-			}
-		}
+	s.svcLock.Lock()
+	defer s.svcLock.Unlock()
 
-		// Find new and lost IPs
-		newIPs := ips.Subtract(s.ipMap[svc])
-		lostIPs := s.ipMap[svc].Subtract(ips)
+	for svc, instances := range lookups {
+		// Find new, changed and lost instances
+		newInstances := instances.Subtract(s.instanceMap[svc])
+		changedInstances := instances.Changed(s.instanceMap[svc])
+		lostInstances := s.instanceMap[svc].Subtract(instances)
 
 		// Update service map
-		s.ipMap[svc] = ips
+		s.instanceMap[svc] = instances
 
 		// Call listeners
 		if s.OnDiscover != nil {
-			for _, ip := range newIPs {
-				s.OnDiscover(svc, ip)
+			for _, instance := range newInstances {
+				s.OnDiscover(svc, instance)
+			}
+		}
+		if s.OnUpdate != nil {
+			for _, instance := range changedInstances {
+				s.OnUpdate(svc, instance)
 			}
 		}
 		if s.OnLost != nil {
-			for _, ip := range lostIPs {
-				s.OnLost(svc, ip)
+			for _, instance := range lostInstances {
+				s.OnLost(svc, instance)
 			}
 		}
 
 	}
 }
 
-func (s *Service) Get(svc string) []net.IP {
+func (s *Service) Get(svc string) []Instance {
 	s.svcLock.Lock()
 	defer s.svcLock.Unlock()
 
-	return s.ipMap[svc]
+	return s.instanceMap[svc]
 }
@@ -0,0 +1,231 @@
+package recording
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The recording service stores the guacamole instruction stream sent to a
+	group's browser. Recordings can be played back with Guacamole.SessionRecording.
+*/
+
+var (
+	ErrNotFound = errors.New("recording not found")
+
+	ID_LENGTH           = 16
+	RANDOM_STRING_CHARS = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// Recording describes a stored recording
+type Recording struct {
+	ID         string    `json:"id"`
+	WorkshopID string    `json:"workshopID"`
+	SessionID  string    `json:"sessionID"`
+	GroupName  string    `json:"groupName"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt,omitempty"`
+	Size       int64     `json:"size"`
+}
+
+// Service ...
+type Service struct {
+	dir string
+}
+
+func New(dir string) (*Service, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create recordings directory: %w", err)
+	}
+	return &Service{dir: dir}, nil
+}
+
+// Start creates a new recording
+func (s *Service) Start(workshopID, sessionID, groupName string) (*Writer, error) {
+	rec := Recording{
+		ID:         createRandomString(ID_LENGTH),
+		WorkshopID: workshopID,
+		SessionID:  sessionID,
+		GroupName:  groupName,
+		StartedAt:  time.Now(),
+	}
+
+	f, err := os.OpenFile(s.dataPath(rec.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		service:   s,
+		file:      f,
+		buf:       bufio.NewWriter(f),
+		writeLock: &sync.Mutex{},
+		recording: rec,
+	}
+	if err := s.saveMeta(rec); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// List returns the recordings of a workshop, or of all workshops if workshopID is empty
+func (s *Service) List(workshopID string) ([]Recording, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := make([]Recording, 0, len(matches))
+	for _, match := range matches {
+		rec, err := s.loadMeta(strings.TrimSuffix(filepath.Base(match), ".json"))
+		if err != nil {
+			log.Printf("Error while reading recording %s: %v", match, err)
+			continue
+		}
+		if workshopID != "" && rec.WorkshopID != workshopID {
+			continue
+		}
+		recordings = append(recordings, rec)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].StartedAt.Before(recordings[j].StartedAt)
+	})
+	return recordings, nil
+}
+
+// Get returns the metadata of a recording
+func (s *Service) Get(id string) (Recording, error) {
+	if !validID(id) {
+		return Recording{}, ErrNotFound
+	}
+	return s.loadMeta(id)
+}
+
+// Open opens the instruction stream of a recording for reading
+func (s *Service) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.dataPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *Service) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".guac")
+}
+
+func (s *Service) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Service) saveMeta(rec Recording) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := s.metaPath(rec.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.metaPath(rec.ID))
+}
+
+func (s *Service) loadMeta(id string) (Recording, error) {
+	data, err := os.ReadFile(s.metaPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Recording{}, ErrNotFound
+	}
+	if err != nil {
+		return Recording{}, err
+	}
+
+	var rec Recording
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// Writer appends instructions to a recording
+type Writer struct {
+	service   *Service
+	file      *os.File
+	buf       *bufio.Writer
+	writeLock sync.Locker
+	recording Recording
+	closed    bool
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := w.buf.Write(p)
+	w.recording.Size += int64(n)
+	return n, err
+}
+
+// Close finishes the recording
+func (w *Writer) Close() error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.recording.EndedAt = time.Now()
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.service.saveMeta(w.recording)
+}
+
+// validID prevents path traversal through recording IDs
+func validID(id string) bool {
+	if len(id) != ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(RANDOM_STRING_CHARS, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func createRandomString(length int) string {
+	seed := make([]byte, length)
+	str := make([]byte, length)
+
+	rand.Read(seed)
+
+	for i := 0; i < length; i++ {
+		str[i] = RANDOM_STRING_CHARS[int(seed[i])%len(RANDOM_STRING_CHARS)]
+	}
+
+	return string(str)
+}
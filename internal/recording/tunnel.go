@@ -0,0 +1,57 @@
+package recording
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/wwt/guac"
+)
+
+// internalOpcode prefixes instructions that are never part of a session
+var internalOpcode = []byte("0.")
+
+// Tunnel records every instruction guacd sends through the wrapped tunnel
+type Tunnel struct {
+	guac.Tunnel
+	writer *Writer
+}
+
+func WrapTunnel(tunnel guac.Tunnel, writer *Writer) *Tunnel {
+	return &Tunnel{
+		Tunnel: tunnel,
+		writer: writer,
+	}
+}
+
+func (t *Tunnel) AcquireReader() guac.InstructionReader {
+	return &reader{
+		InstructionReader: t.Tunnel.AcquireReader(),
+		writer:            t.writer,
+	}
+}
+
+// Close closes the tunnel and finishes the recording
+func (t *Tunnel) Close() error {
+	if err := t.writer.Close(); err != nil {
+		log.Printf("[Recording] Error while closing recording: %v", err)
+	}
+	return t.Tunnel.Close()
+}
+
+type reader struct {
+	guac.InstructionReader
+	writer *Writer
+}
+
+func (r *reader) ReadSome() ([]byte, error) {
+	ins, err := r.InstructionReader.ReadSome()
+	if err != nil {
+		return ins, err
+	}
+	if !bytes.HasPrefix(ins, internalOpcode) {
+		if _, err := r.writer.Write(ins); err != nil {
+			log.Printf("[Recording] Error while writing recording: %v", err)
+		}
+	}
+	return ins, nil
+}
@@ -0,0 +1,247 @@
+package sandbox
+
+import "strconv"
+
+var (
+	// DEFAULT_SERIAL_CHANNEL is the channel of sandboxes with a single serial port
+	DEFAULT_SERIAL_CHANNEL = "default"
+	// DEFAULT_PORTS are used for the remote desktop if the connection has no port
+	DEFAULT_PORTS = map[string]int{"rdp": 3389, "vnc": 5900, "ssh": 22}
+)
+
+// ProtocolSSH connections show a terminal instead of a desktop
+const ProtocolSSH = "ssh"
+
+// SerialChannel is a serial device forwarded to the agent listening on Port
+type SerialChannel struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+// Connection describes how to reach the remote desktop and serial agent of a sandbox
+type Connection struct {
+	Protocol   string `json:"protocol,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	SerialPort int    `json:"serialPort,omitempty"`
+	// SerialProtocol is spoken by the serial agent, "raw" (socat) or "framed"
+	SerialProtocol string `json:"serialProtocol,omitempty"`
+	// SerialChannels forwards several serial devices, replacing SerialPort
+	SerialChannels []SerialChannel `json:"serialChannels,omitempty"`
+	// Terminal configures connections using ProtocolSSH
+	Terminal *Terminal `json:"terminal,omitempty"`
+	// Clipboard limits the clipboard of the groups, it is unrestricted if nil
+	Clipboard *Clipboard `json:"clipboard,omitempty"`
+	// Parameters holds additional guacd parameters, such as security
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// Terminal configures the terminal of an ssh connection
+type Terminal struct {
+	// PrivateKey authenticates the user instead of the password, in OpenSSH PEM format
+	PrivateKey string `json:"privateKey,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	// HostKey is the expected public key of the sandbox, any key is accepted if empty
+	HostKey     string `json:"hostKey,omitempty"`
+	FontName    string `json:"fontName,omitempty"`
+	FontSize    int    `json:"fontSize,omitempty"`
+	ColorScheme string `json:"colorScheme,omitempty"`
+	// Scrollback is the number of lines kept above the screen
+	Scrollback int `json:"scrollback,omitempty"`
+	// SFTP enables file transfer, rooted at SFTPRoot
+	SFTP     bool   `json:"sftp,omitempty"`
+	SFTPRoot string `json:"sftpRoot,omitempty"`
+}
+
+// Merge returns a copy of t with every non-empty field of override applied
+func (t *Terminal) Merge(override *Terminal) *Terminal {
+	var c Terminal
+	if t != nil {
+		c = *t
+	}
+	if override == nil {
+		return &c
+	}
+	if override.PrivateKey != "" {
+		c.PrivateKey = override.PrivateKey
+	}
+	if override.Passphrase != "" {
+		c.Passphrase = override.Passphrase
+	}
+	if override.HostKey != "" {
+		c.HostKey = override.HostKey
+	}
+	if override.FontName != "" {
+		c.FontName = override.FontName
+	}
+	if override.FontSize != 0 {
+		c.FontSize = override.FontSize
+	}
+	if override.ColorScheme != "" {
+		c.ColorScheme = override.ColorScheme
+	}
+	if override.Scrollback != 0 {
+		c.Scrollback = override.Scrollback
+	}
+	if override.SFTP {
+		c.SFTP = true
+	}
+	if override.SFTPRoot != "" {
+		c.SFTPRoot = override.SFTPRoot
+	}
+	return &c
+}
+
+// Parameters returns the guacd parameters of the terminal, empty settings
+// are left to guacd
+func (t *Terminal) Parameters() map[string]string {
+	parameters := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			parameters[key] = value
+		}
+	}
+	set("private-key", t.PrivateKey)
+	set("passphrase", t.Passphrase)
+	set("host-key", t.HostKey)
+	set("font-name", t.FontName)
+	set("color-scheme", t.ColorScheme)
+	if t.FontSize != 0 {
+		set("font-size", strconv.Itoa(t.FontSize))
+	}
+	if t.Scrollback != 0 {
+		set("scrollback", strconv.Itoa(t.Scrollback))
+	}
+	if t.SFTP {
+		set("enable-sftp", "true")
+		set("sftp-root-directory", t.SFTPRoot)
+	}
+	return parameters
+}
+
+// Clipboard limits the clipboard between the browser of a group and the sandbox
+type Clipboard struct {
+	// DisableCopy blocks copying text from the sandbox to the browser
+	DisableCopy bool `json:"disableCopy,omitempty"`
+	// DisablePaste blocks pasting text from the browser into the sandbox
+	DisablePaste bool `json:"disablePaste,omitempty"`
+	// MaxSize is the largest clipboard in bytes passed either way, unlimited if zero
+	MaxSize int `json:"maxSize,omitempty"`
+}
+
+// Merge returns a copy of c with every non-empty field of override applied,
+// so a restriction cannot be lifted by an override
+func (c *Clipboard) Merge(override *Clipboard) *Clipboard {
+	var m Clipboard
+	if c != nil {
+		m = *c
+	}
+	if override == nil {
+		return &m
+	}
+	if override.DisableCopy {
+		m.DisableCopy = true
+	}
+	if override.DisablePaste {
+		m.DisablePaste = true
+	}
+	if override.MaxSize != 0 && (m.MaxSize == 0 || override.MaxSize < m.MaxSize) {
+		m.MaxSize = override.MaxSize
+	}
+	return &m
+}
+
+// Parameters returns the guacd parameters enforcing the clipboard policy
+func (c *Clipboard) Parameters() map[string]string {
+	parameters := map[string]string{}
+	if c.DisableCopy {
+		parameters["disable-copy"] = "true"
+	}
+	if c.DisablePaste {
+		parameters["disable-paste"] = "true"
+	}
+	return parameters
+}
+
+// RemotePort returns the port of the remote desktop, or the default port of the protocol
+func (c Connection) RemotePort() int {
+	if c.Port != 0 {
+		return c.Port
+	}
+	return DEFAULT_PORTS[c.Protocol]
+}
+
+// Ports returns the ports the sandbox must serve
+func (c Connection) Ports() []int {
+	var ports []int
+	if port := c.RemotePort(); port != 0 {
+		ports = append(ports, port)
+	}
+	for _, channel := range c.Channels() {
+		if channel.Port != 0 {
+			ports = append(ports, channel.Port)
+		}
+	}
+	return ports
+}
+
+// Channels returns the serial channels, or the default channel on SerialPort
+func (c Connection) Channels() []SerialChannel {
+	if len(c.SerialChannels) > 0 {
+		return c.SerialChannels
+	}
+	return []SerialChannel{{Name: DEFAULT_SERIAL_CHANNEL, Port: c.SerialPort}}
+}
+
+// Channel returns the serial channel with the given name
+func (c Connection) Channel(name string) (SerialChannel, bool) {
+	for _, channel := range c.Channels() {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+	return SerialChannel{}, false
+}
+
+// Merge returns a copy of c with every non-empty field of override applied
+func (c Connection) Merge(override Connection) Connection {
+	if override.Protocol != "" {
+		c.Protocol = override.Protocol
+	}
+	if override.Port != 0 {
+		c.Port = override.Port
+	}
+	if override.Username != "" {
+		c.Username = override.Username
+	}
+	if override.Password != "" {
+		c.Password = override.Password
+	}
+	if override.SerialPort != 0 {
+		c.SerialPort = override.SerialPort
+	}
+	if override.SerialProtocol != "" {
+		c.SerialProtocol = override.SerialProtocol
+	}
+	if len(override.SerialChannels) > 0 {
+		c.SerialChannels = override.SerialChannels
+	}
+	if override.Terminal != nil {
+		c.Terminal = c.Terminal.Merge(override.Terminal)
+	}
+	if override.Clipboard != nil {
+		c.Clipboard = c.Clipboard.Merge(override.Clipboard)
+	}
+
+	parameters := make(map[string]string, len(c.Parameters)+len(override.Parameters))
+	for key, value := range c.Parameters {
+		parameters[key] = value
+	}
+	for key, value := range override.Parameters {
+		parameters[key] = value
+	}
+	c.Parameters = parameters
+
+	return c
+}
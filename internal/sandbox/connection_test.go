@@ -0,0 +1,25 @@
+package sandbox
+
+import "testing"
+
+func TestClipboardMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     *Clipboard
+		override *Clipboard
+		want     Clipboard
+	}{
+		{"no override", &Clipboard{DisableCopy: true, MaxSize: 100}, nil, Clipboard{DisableCopy: true, MaxSize: 100}},
+		{"no base", nil, &Clipboard{DisablePaste: true, MaxSize: 100}, Clipboard{DisablePaste: true, MaxSize: 100}},
+		{"restrictions add up", &Clipboard{DisableCopy: true}, &Clipboard{DisablePaste: true}, Clipboard{DisableCopy: true, DisablePaste: true}},
+		{"smaller override", &Clipboard{MaxSize: 100}, &Clipboard{MaxSize: 10}, Clipboard{MaxSize: 10}},
+		{"larger override", &Clipboard{MaxSize: 100}, &Clipboard{MaxSize: 1000}, Clipboard{MaxSize: 100}},
+		{"unlimited base", &Clipboard{}, &Clipboard{MaxSize: 1000}, Clipboard{MaxSize: 1000}},
+		{"unlimited override", &Clipboard{MaxSize: 100}, &Clipboard{}, Clipboard{MaxSize: 100}},
+	}
+	for _, test := range tests {
+		if got := test.base.Merge(test.override); *got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
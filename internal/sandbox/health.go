@@ -0,0 +1,80 @@
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Health of a sandbox as determined by the last probe
+type Health string
+
+const (
+	HealthUnknown   Health = "unknown"
+	HealthHealthy   Health = "healthy"
+	HealthUnhealthy Health = "unhealthy"
+)
+
+// Probe dials the remote desktop and serial port of every sandbox and records
+// the result. A sandbox is healthy only if all ports accept a connection within timeout.
+// The sandboxes whose health changed are returned.
+func (s *Service) Probe(timeout time.Duration) []Sandbox {
+	// Probe outside of the lock, dialing can take a while
+	var ips ipList
+	var ports [][]int
+	s.storeLock.Lock()
+	for _, sandbox := range s.store {
+		ips = append(ips, sandbox.IP)
+		ports = append(ports, sandbox.Connection.Ports())
+	}
+	s.storeLock.Unlock()
+
+	results := make([]error, len(ips))
+	wg := sync.WaitGroup{}
+	for ix, ip := range ips {
+		wg.Add(1)
+		go func(ix int, ip net.IP) {
+			defer wg.Done()
+			results[ix] = probe(ip, ports[ix], timeout)
+		}(ix, ip)
+	}
+	wg.Wait()
+
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	var changed []Sandbox
+	now := time.Now()
+	for ix, ip := range ips {
+		sandbox := s.get(ip)
+		if sandbox == nil {
+			continue
+		}
+
+		health, lastError := HealthHealthy, ""
+		if results[ix] != nil {
+			health, lastError = HealthUnhealthy, results[ix].Error()
+		}
+		sandbox.LastChecked = now
+		if sandbox.Health != health || sandbox.LastError != lastError {
+			sandbox.Health = health
+			sandbox.LastError = lastError
+			changed = append(changed, *sandbox)
+		}
+	}
+	return changed
+}
+
+func probe(ip net.IP, ports []int, timeout time.Duration) error {
+	for _, port := range ports {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return fmt.Errorf("port %d: %w", port, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
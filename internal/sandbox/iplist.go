@@ -1,4 +1,4 @@
-package discovery
+package sandbox
 
 import "net"
 
@@ -13,11 +13,11 @@ func (l ipList) Contains(ip net.IP) bool {
 	return false
 }
 
-func (l ipList) Subtract(other ipList) ipList {
+func (l ipList) Remove(ip net.IP) ipList {
 	var result ipList
-	for _, ip := range l {
-		if !other.Contains(ip) {
-			result = append(result, ip)
+	for _, i := range l {
+		if !i.Equal(ip) {
+			result = append(result, i)
 		}
 	}
 	return result
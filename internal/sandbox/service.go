@@ -3,8 +3,12 @@ package sandbox
 import (
 	"crypto/rand"
 	"errors"
+	"log"
 	"net"
 	"sync"
+	"time"
+
+	"remoto.senwize.com/internal/storage"
 )
 
 /*
@@ -19,46 +23,70 @@ var (
 	ErrSandboxReserved = errors.New("sandbox reserved")
 
 	KEY_LENGTH = 16
+
+	// Storage key
+	STORAGE_KEY = "reservations"
 )
 
 // Sandbox ...
 type Sandbox struct {
-	IP       net.IP
-	Reserved bool
+	IP         net.IP
+	Workshop   string
+	Reserved   bool
+	Connection Connection
+
+	Health      Health
+	LastError   string
+	LastChecked time.Time
 }
 
 // Service ...
 type Service struct {
 	storeLock sync.Locker
-	store     []Sandbox
+	store     []*Sandbox
+	storage   storage.Store
+
+	// restored holds reservations from before a restart for sandboxes
+	// that have not been rediscovered yet
+	restored ipList
 }
 
-func New() *Service {
-	return &Service{
+func New(store storage.Store) *Service {
+	s := &Service{
 		storeLock: &sync.Mutex{},
-		store:     []Sandbox{},
+		store:     []*Sandbox{},
+		storage:   store,
 	}
+	s.restore()
+	return s
 }
 
 func (s *Service) List() []Sandbox {
 	s.storeLock.Lock()
 	defer s.storeLock.Unlock()
 
-	return s.store
+	sandboxes := make([]Sandbox, len(s.store))
+	for ix, sandbox := range s.store {
+		sandboxes[ix] = *sandbox
+	}
+	return sandboxes
 }
 
-func (s *Service) ReserveFree() (*Sandbox, error) {
+// ReserveFree reserves a free sandbox from the pool of a workshop
+func (s *Service) ReserveFree(workshop string) (*Sandbox, error) {
 	s.storeLock.Lock()
 	defer s.storeLock.Unlock()
 
-	free := s.getFree()
+	free := s.getFree(workshop)
 	if free == nil {
 		return nil, ErrNoSandboxFree
 	}
 
 	free.Reserved = true
+	s.persist()
 
-	return free, nil
+	c := *free
+	return &c, nil
 }
 
 func (s *Service) Reserve(ip net.IP) (*Sandbox, error) {
@@ -74,40 +102,127 @@ func (s *Service) Reserve(ip net.IP) (*Sandbox, error) {
 		return nil, ErrSandboxReserved
 	}
 	sandbox.Reserved = true
+	s.persist()
 
-	return sandbox, nil
+	c := *sandbox
+	return &c, nil
 }
 
+// Release frees the reservation of the sandbox with the IP of sandbox, also
+// if it is not discovered at the moment
 func (s *Service) Release(sandbox *Sandbox) {
-	sandbox.Reserved = false
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	if stored := s.get(sandbox.IP); stored != nil {
+		stored.Reserved = false
+	}
+	s.restored = s.restored.Remove(sandbox.IP)
+	s.persist()
 }
 
-func (s *Service) Add(ip net.IP) {
+// Get returns a copy of the sandbox with the given IP
+func (s *Service) Get(ip net.IP) (Sandbox, error) {
 	s.storeLock.Lock()
 	defer s.storeLock.Unlock()
 
-	s.store = append(s.store, Sandbox{
-		IP: ip,
-	})
+	sandbox := s.get(ip)
+	if sandbox == nil {
+		return Sandbox{}, ErrNotFound
+	}
+	return *sandbox, nil
 }
 
+// Add registers a sandbox, if the sandbox was reserved before a restart
+// it is reserved again and returned with Reserved set. Like all sandboxes
+// returned by the service, the result is a copy.
+func (s *Service) Add(ip net.IP, workshop string, connection Connection) *Sandbox {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	sandbox := &Sandbox{
+		IP:         ip,
+		Workshop:   workshop,
+		Reserved:   s.restored.Contains(ip),
+		Connection: connection,
+		Health:     HealthUnknown,
+	}
+	s.restored = s.restored.Remove(ip)
+	s.store = append(s.store, sandbox)
+
+	c := *sandbox
+	return &c
+}
+
+// Update replaces the connection of a sandbox
+func (s *Service) Update(ip net.IP, connection Connection) error {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	sandbox := s.get(ip)
+	if sandbox == nil {
+		return ErrNotFound
+	}
+	sandbox.Connection = connection
+	return nil
+}
+
+// Delete forgets a sandbox that is no longer discovered. A reservation is
+// kept like a restored one, so the sandbox is reserved again when it is
+// rediscovered instead of being handed to another session.
 func (s *Service) Delete(ip net.IP) {
 	s.storeLock.Lock()
 	defer s.storeLock.Unlock()
 
 	for ix := range s.store {
-		sandbox := &s.store[ix]
+		sandbox := s.store[ix]
 		if sandbox.IP.Equal(ip) {
+			if sandbox.Reserved && !s.restored.Contains(ip) {
+				s.restored = append(s.restored, ip)
+			}
 			s.store[ix] = s.store[len(s.store)-1]
 			s.store = s.store[:len(s.store)-1]
+			break
 		}
 	}
 }
 
-func (s *Service) getFree() *Sandbox {
-	for ix := range s.store {
-		sandbox := &s.store[ix]
-		if !sandbox.Reserved {
+// restore loads the reservations persisted before the last shutdown
+func (s *Service) restore() {
+	var reserved ipList
+	err := s.storage.Load(STORAGE_KEY, &reserved)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error while restoring reservations: %v", err)
+		return
+	}
+
+	s.restored = reserved
+	log.Printf("Restored %d sandbox reservations", len(reserved))
+}
+
+// persist saves the reserved sandboxes to storage, must be called with the lock held
+func (s *Service) persist() {
+	// Reservations of sandboxes that are not rediscovered yet are kept
+	reserved := make(ipList, 0, len(s.store)+len(s.restored))
+	reserved = append(reserved, s.restored...)
+	for _, sandbox := range s.store {
+		if sandbox.Reserved {
+			reserved = append(reserved, sandbox.IP)
+		}
+	}
+
+	if err := s.storage.Save(STORAGE_KEY, reserved); err != nil {
+		log.Printf("Error while persisting reservations: %v", err)
+	}
+}
+
+// getFree returns the first unreserved sandbox of a workshop that is not known to be unhealthy
+func (s *Service) getFree(workshop string) *Sandbox {
+	for _, sandbox := range s.store {
+		if sandbox.Workshop == workshop && !sandbox.Reserved && sandbox.Health != HealthUnhealthy {
 			return sandbox
 		}
 	}
@@ -115,8 +230,8 @@ func (s *Service) getFree() *Sandbox {
 }
 
 func (s *Service) exists(ip net.IP) bool {
-	for ix := range s.store {
-		if s.store[ix].IP.Equal(ip) {
+	for _, sandbox := range s.store {
+		if sandbox.IP.Equal(ip) {
 			return true
 		}
 	}
@@ -124,8 +239,7 @@ func (s *Service) exists(ip net.IP) bool {
 }
 
 func (s *Service) get(ip net.IP) *Sandbox {
-	for ix := range s.store {
-		sandbox := &s.store[ix]
+	for _, sandbox := range s.store {
 		if sandbox.IP.Equal(ip) {
 			return sandbox
 		}
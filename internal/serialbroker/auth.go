@@ -0,0 +1,55 @@
+package serialbroker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("agent authentication failed")
+
+	// Size of the challenge sent by agents
+	CHALLENGE_SIZE = 32
+	// Time allowed for the handshake
+	HANDSHAKE_TIMEOUT = 5 * time.Second
+)
+
+// NewChallenge returns a random challenge for a hello frame
+func NewChallenge() []byte {
+	challenge := make([]byte, CHALLENGE_SIZE)
+	rand.Read(challenge)
+	return challenge
+}
+
+// AuthResponse proves knowledge of the token without sending it
+func AuthResponse(token string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// VerifyAuth checks the response to a challenge
+func VerifyAuth(token string, challenge, response []byte) bool {
+	return hmac.Equal(AuthResponse(token, challenge), response)
+}
+
+// answerHello reads the hello frame of a framed agent and answers its challenge
+func answerHello(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello, err := ReadFrame(conn)
+	if err != nil {
+		return fmt.Errorf("reading hello: %w", err)
+	}
+	if hello.Type != FrameHello || len(hello.Payload) != CHALLENGE_SIZE {
+		return fmt.Errorf("%w: expected hello frame", ErrInvalidFrame)
+	}
+
+	return WriteFrame(conn, Frame{Type: FrameAuth, Payload: AuthResponse(token, hello.Payload)})
+}
@@ -1,30 +1,203 @@
 package serialbroker
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"remoto.senwize.com/internal/sandbox"
 	"remoto.senwize.com/internal/session"
 )
 
-/*
-	TODO: try and recover from (TCP)socket errors to avoid closing the WebSocket connection
-*/
+var (
+	ErrNotFound       = errors.New("no serial stream for session")
+	ErrUnknownChannel = errors.New("unknown serial channel")
+	ErrHostRefused    = errors.New("admin may not tunnel to this host")
 
-func HandleWebsocket(port int) http.HandlerFunc {
-	upgrader := &websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
+	// Channel names are used in transcript file names
+	channelPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+	// Bytes of serial traffic kept per session if not configured
+	TRANSCRIPT_DEFAULT_SIZE = 64 * 1024
+	// Time the agent connection is kept after the browser disconnected, if not configured
+	GRACE_DEFAULT_PERIOD = 60 * time.Second
+	// Time to connect to an agent
+	DIAL_TIMEOUT = 5 * time.Second
+	// Bytes buffered per tunnel direction if not configured
+	BUFFER_DEFAULT_SIZE = 256 * 1024
+	// Bytes read from raw agents and websockets at once if not configured
+	READ_BUFFER_DEFAULT_SIZE = 4 * 1024
+)
+
+// Config ...
+type Config struct {
+	// Agent returns how to reach the serial agent of a sandbox channel
+	Agent func(ip net.IP, channel string) (Agent, error)
+	// Authorize returns nil if an admin may tunnel to the host given with the
+	// hostname query parameter, admins cannot choose a host if it is nil
+	Authorize func(admin *session.Session, ip net.IP) error
+	// AgentToken authenticates the broker to framed agents
+	AgentToken string
+	// TranscriptSize is the number of bytes of serial traffic kept in memory per session
+	TranscriptSize int
+	// TranscriptDir is where transcripts are saved, they are kept in memory only if empty
+	TranscriptDir string
+	// GracePeriod is how long the agent connection is kept for a browser to reconnect
+	GracePeriod time.Duration
+	// BufferSize is the number of bytes a tunnel buffers per direction, for a
+	// browser that has not acknowledged them or an agent that is being redialed
+	BufferSize int
+	// ReadBufferSize is the number of bytes read from raw agents and websockets at once
+	ReadBufferSize int
+}
+
+// Broker tunnels websockets to the serial agents of the sandboxes and keeps
+// a transcript of the traffic of every session and channel
+type Broker struct {
+	cfg         Config
+	upgrader    *websocket.Upgrader
+	tapUpgrader *websocket.Upgrader
+
+	streamsLock sync.Locker
+	streams     map[streamKey]*stream
+}
+
+type streamKey struct {
+	sessionID string
+	channel   string
+}
+
+func New(cfg Config) (*Broker, error) {
+	if cfg.TranscriptSize <= 0 {
+		cfg.TranscriptSize = TRANSCRIPT_DEFAULT_SIZE
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = GRACE_DEFAULT_PERIOD
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = BUFFER_DEFAULT_SIZE
+	}
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = READ_BUFFER_DEFAULT_SIZE
+	}
+	if cfg.TranscriptDir != "" {
+		if err := os.MkdirAll(cfg.TranscriptDir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create transcript directory: %w", err)
+		}
+	}
+
+	return &Broker{
+		cfg: cfg,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.ReadBufferSize,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			Subprotocols: []string{SUBPROTOCOL_FRAMED, SUBPROTOCOL_BINARY},
+		},
+		tapUpgrader: &websocket.Upgrader{
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.ReadBufferSize,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			Subprotocols: []string{SUBPROTOCOL_BINARY},
 		},
+		streamsLock: &sync.Mutex{},
+		streams:     map[streamKey]*stream{},
+	}, nil
+}
+
+// Transcript returns the recent serial traffic of a session channel
+func (b *Broker) Transcript(sessionID, channel string) ([]Entry, error) {
+	b.streamsLock.Lock()
+	defer b.streamsLock.Unlock()
+
+	s, ok := b.streams[streamKey{sessionID, channel}]
+	if !ok {
+		return nil, ErrNotFound
 	}
+	return s.transcript.Entries(), nil
+}
+
+// Stats returns the traffic of the serial tunnels of a session, sorted by channel
+func (b *Broker) Stats(sessionID string) []ChannelStats {
+	b.streamsLock.Lock()
+	defer b.streamsLock.Unlock()
 
+	var stats []ChannelStats
+	for key, s := range b.streams {
+		if key.sessionID == sessionID {
+			stats = append(stats, s.tunnel.stats(key.channel))
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Channel < stats[j].Channel
+	})
+	return stats
+}
+
+// Forget disconnects the tunnels and taps of all channels of a session and
+// drops their transcripts
+func (b *Broker) Forget(sessionID string) {
+	b.streamsLock.Lock()
+	defer b.streamsLock.Unlock()
+
+	for key, s := range b.streams {
+		if key.sessionID == sessionID {
+			s.close()
+			delete(b.streams, key)
+		}
+	}
+}
+
+// stream returns the stream of a session channel, creating it if necessary
+func (b *Broker) stream(sessionID, channel string) *stream {
+	b.streamsLock.Lock()
+	defer b.streamsLock.Unlock()
+
+	key := streamKey{sessionID, channel}
+	s, ok := b.streams[key]
+	if !ok {
+		dial := func(ip net.IP) (*agentConn, error) {
+			return b.dialAgent(ip, channel)
+		}
+		s = newStream(sessionID+"-"+channel, b.cfg, dial)
+		b.streams[key] = s
+	}
+	return s
+}
+
+// Channel returns the channel requested with the channel query parameter
+func Channel(r *http.Request) (string, error) {
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		return sandbox.DEFAULT_SERIAL_CHANNEL, nil
+	}
+	if !channelPattern.MatchString(channel) {
+		return "", ErrUnknownChannel
+	}
+	return channel, nil
+}
+
+// HandleWebsocket tunnels the websocket to the serial agent of a channel of
+// the session's sandbox, the channel query parameter selects the channel.
+// The agent connection is kept for the grace period after the websocket closes,
+// so a browser reconnecting with the resume query parameter continues where it left off.
+func (b *Broker) HandleWebsocket() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		webSock, err := upgrader.Upgrade(rw, r, nil)
+		webSock, err := b.upgrader.Upgrade(rw, r, nil)
 		if err != nil {
 			return
 		}
@@ -44,6 +217,15 @@ func HandleWebsocket(port int) http.HandlerFunc {
 		query := r.URL.Query()
 		if s.IsAdmin && query.Get("hostname") != "" {
 			ip = net.ParseIP(query.Get("hostname"))
+			err := ErrHostRefused
+			if ip != nil && b.cfg.Authorize != nil {
+				err = b.cfg.Authorize(s, ip)
+			}
+			if err != nil {
+				log.Printf("[WS] Refusing serial tunnel of admin (%s) to %s: %v\n", s.GroupName, query.Get("hostname"), err)
+				webSock.Close()
+				return
+			}
 		} else if s.Sandbox != nil {
 			ip = s.Sandbox.IP
 		} else {
@@ -52,76 +234,167 @@ func HandleWebsocket(port int) http.HandlerFunc {
 			return
 		}
 
-		// Create tcp connection to pico agent
-		picoSock, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: ip, Port: port})
+		channel, err := Channel(r)
+		if err == nil {
+			_, err = b.cfg.Agent(ip, channel)
+		}
 		if err != nil {
-			log.Printf("[SerialTunnel] failed to connect to pico agent: %v\n", err)
+			log.Printf("[WS] Cannot start serial tunnel: %v\n", err)
+			webSock.Close()
 			return
 		}
 
-		log.Printf("[SerialTunnel] Connected session (%s) to serial tunnel tcp (%s)\n", s.GroupName, ip)
+		// Last sequence number the browser received before reconnecting
+		var resume *uint32
+		if v := query.Get("resume"); v != "" {
+			seq, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				log.Printf("[WS] Invalid resume sequence number: %s\n", v)
+				webSock.Close()
+				return
+			}
+			resume = new(uint32)
+			*resume = uint32(seq)
+		}
 
-		done := make(chan struct{})
-		errC := make(chan error)
+		browser := newBrowserConn(webSock)
+		tunnel := b.stream(s.ID, channel).tunnel
+		tunnel.attach(browser, s.GroupName+"/"+channel, ip, resume)
+		log.Printf("[SerialTunnel] Connected session (%s) to serial tunnel tcp (%s), channel: %s, framed browser: %t, resumed: %t\n", s.GroupName, ip, channel, browser.framed, resume != nil)
 
-		// Pipe everything to tcp socket
-		go readPipe(done, errC, webSock, picoSock)
-		go writePipe(done, errC, webSock, picoSock)
+		for {
+			frame, err := browser.ReadFrame()
+			if errors.Is(err, ErrInvalidFrame) {
+				log.Printf("[WS >> TCP] Dropping frame: %v\n", err)
+				continue
+			}
+			if err != nil {
+				log.Printf("[SerialTunnel] Websocket for (%s) disconnected: %v\n", s.GroupName, err)
+				break
+			}
+			if frame.Type != FrameAck && !validFrame(frame) {
+				continue
+			}
+			tunnel.fromBrowser(browser, frame)
+		}
 
-		webSock.SetCloseHandler(func(code int, text string) error {
-			log.Printf("[SerialTunnel] Websocket for (%s) disconnected: %d %s\n", s.GroupName, code, text)
-			close(done)
-			return nil
-		})
+		tunnel.detach(browser)
+		browser.Close()
+	}
+}
 
-		select {
-		case err := <-errC:
-			log.Printf("[SerialTunnel] (%s) Error: %v\n", s.GroupName, err)
-			close(done)
-		case <-done:
-			log.Println("[SerialTunnel] Done")
-		}
+// Upload sends a file to the agent of a session channel, which places it in
+// the sandbox. The serial tunnel of the channel must be connected, the
+// browser receives the progress of the upload as file frames.
+func (b *Broker) Upload(sessionID, channel, name string, size int64, r io.Reader) (FileEvent, error) {
+	b.streamsLock.Lock()
+	s, ok := b.streams[streamKey{sessionID, channel}]
+	b.streamsLock.Unlock()
+	if !ok {
+		return FileEvent{}, ErrNotConnected
+	}
+
+	log.Printf("[SerialTunnel] Uploading %s (%d bytes) to channel %s of session %s\n", name, size, channel, sessionID)
+	return s.tunnel.upload(name, size, r)
+}
 
-		webSock.Close()
-		picoSock.Close()
+// dialAgent connects to the serial agent of a sandbox channel
+func (b *Broker) dialAgent(ip net.IP, channel string) (*agentConn, error) {
+	agent, err := b.cfg.Agent(ip, channel)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", (&net.TCPAddr{IP: ip, Port: agent.Port}).String(), DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
 	}
+
+	if agent.Protocol == ProtocolFramed {
+		if err := answerHello(conn, b.cfg.AgentToken); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	return newAgentConn(conn, agent.Protocol, b.cfg.ReadBufferSize), nil
 }
 
-func readPipe(done chan struct{}, errC chan error, webSock *websocket.Conn, picoSock net.Conn) {
-outer:
-	for {
-		select {
-		case <-done:
-			break outer
-		default:
-			_, msg, err := webSock.ReadMessage()
-			if err != nil {
-				errC <- fmt.Errorf("[WS >> TCP] %w", err)
-				break outer
+// Tap attaches the websocket read-only to the serial output of a session channel.
+// The recent output is sent first, followed by the live output. Taps that
+// negotiate SUBPROTOCOL_BINARY receive binary messages.
+func (b *Broker) Tap(rw http.ResponseWriter, r *http.Request, sessionID, channel string) {
+	webSock, err := b.tapUpgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	defer webSock.Close()
+	messageType := dataMessageType(webSock.Subprotocol() == SUBPROTOCOL_BINARY)
+
+	backlog, entries, unsubscribe := b.stream(sessionID, channel).subscribe()
+	defer unsubscribe()
+
+	// Discard anything the tap sends, the socket is read-only
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := webSock.ReadMessage(); err != nil {
+				return
 			}
-			log.Printf("[WS >> TCP] %s\n", msg)
-			picoSock.Write(msg)
+		}
+	}()
+
+	write := func(data []byte) error {
+		webSock.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		return webSock.WriteMessage(messageType, data)
+	}
+
+	for _, entry := range backlog {
+		if entry.Direction != DirectionDevice {
+			continue
+		}
+		if err := write(entry.Data); err != nil {
+			return
 		}
 	}
-	log.Printf("[WS >> TCP] Disconnected\n")
-}
 
-func writePipe(done chan struct{}, errC chan error, webSock *websocket.Conn, picoSock net.Conn) {
-	buf := make([]byte, 1024)
-outer:
 	for {
 		select {
-		case <-done:
-			break outer
-		default:
-			n, err := picoSock.Read(buf)
-			if err != nil {
-				errC <- fmt.Errorf("[TCP >> WS] %w", err)
-				break outer
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if entry.Direction != DirectionDevice {
+				continue
+			}
+			if err := write(entry.Data); err != nil {
+				return
 			}
-			log.Printf("[TCP >> WS] %s\n", buf[:n])
-			webSock.WriteMessage(websocket.TextMessage, buf[:n])
+		case <-closed:
+			return
 		}
 	}
-	log.Printf("[TCP >> WS] Disconnected\n")
+}
+
+// validFrame returns false for frames that should not be forwarded
+func validFrame(frame Frame) bool {
+	if frame.Type == FrameData {
+		return true
+	}
+	if frame.Type == FrameFile {
+		if _, err := frame.FileEvent(); err != nil {
+			log.Printf("[SerialTunnel] Dropping file frame: %v\n", err)
+			return false
+		}
+		return true
+	}
+	if frame.Type != FrameControl {
+		log.Printf("[SerialTunnel] Dropping unexpected frame of type %d\n", frame.Type)
+		return false
+	}
+	if _, err := frame.Control(); err != nil {
+		log.Printf("[SerialTunnel] Dropping control frame: %v\n", err)
+		return false
+	}
+	return true
 }
@@ -0,0 +1,289 @@
+package serialbroker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/session"
+)
+
+const testTimeout = 5 * time.Second
+
+// testAgent hands out in-memory agent connections, the test gets the agent
+// side of every connection the broker dials
+type testAgent struct {
+	conns chan net.Conn
+}
+
+func (a *testAgent) dial(ip net.IP) (*agentConn, error) {
+	broker, agent := net.Pipe()
+	a.conns <- agent
+	return newAgentConn(broker, ProtocolFramed, READ_BUFFER_DEFAULT_SIZE), nil
+}
+
+// next returns the agent side of the next connection the broker dials
+func (a *testAgent) next(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-a.conns:
+		conn.SetDeadline(time.Now().Add(testTimeout))
+		return conn
+	case <-time.After(testTimeout):
+		t.Fatal("broker did not dial the agent")
+		return nil
+	}
+}
+
+// newTestBroker serves the websocket of a session whose default channel is
+// tunneled to a testAgent
+func newTestBroker(t *testing.T) (*Broker, *testAgent, string) {
+	t.Helper()
+	b, err := New(Config{
+		Agent: func(ip net.IP, channel string) (Agent, error) {
+			return Agent{Protocol: ProtocolFramed}, nil
+		},
+		GracePeriod: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := &testAgent{conns: make(chan net.Conn, 4)}
+	b.streams[streamKey{"session", sandbox.DEFAULT_SERIAL_CHANNEL}] = newStream("test", b.cfg, agent.dial)
+
+	ses := &session.Session{
+		ID:        "session",
+		GroupName: "group",
+		Sandbox:   &sandbox.Sandbox{IP: net.IPv4(127, 0, 0, 1)},
+	}
+	handler := b.HandleWebsocket()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(session.With(r.Context(), ses)))
+	}))
+	t.Cleanup(func() {
+		b.Forget("session")
+		srv.Close()
+	})
+
+	return b, agent, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialBrowser connects a framed browser, query is appended to the url
+func dialBrowser(t *testing.T, url, query string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{SUBPROTOCOL_FRAMED}}
+	ws, _, err := dialer.Dial(url+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func sendFrame(t *testing.T, ws *websocket.Conn, f Frame) {
+	t.Helper()
+	if err := ws.WriteMessage(websocket.BinaryMessage, f.MarshalMessage()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, ws *websocket.Conn) Frame {
+	t.Helper()
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := UnmarshalMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// readData reads data frames until n payload bytes arrived, checking that the
+// sequence numbers continue after seq
+func readData(t *testing.T, ws *websocket.Conn, seq uint32, n int) []byte {
+	t.Helper()
+	var data []byte
+	for len(data) < n {
+		f := readFrame(t, ws)
+		if f.Type == FrameAck {
+			continue
+		}
+		if f.Type != FrameData {
+			t.Fatalf("got frame of type %d, want data", f.Type)
+		}
+		if f.Seq != seq+1 {
+			t.Fatalf("got frame %d, want %d", f.Seq, seq+1)
+		}
+		seq = f.Seq
+		data = append(data, f.Payload...)
+	}
+	return data
+}
+
+// readAgentData reads data frames from the agent side until n payload bytes arrived
+func readAgentData(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	var data []byte
+	for len(data) < n {
+		f, err := ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != FrameData {
+			t.Fatalf("agent got frame of type %d, want data", f.Type)
+		}
+		data = append(data, f.Payload...)
+	}
+	return data
+}
+
+// testPayloads returns every byte value in both orders, followed by a payload
+// of the largest size
+func testPayloads() [][]byte {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	reversed := make([]byte, 256)
+	for i := range reversed {
+		reversed[i] = byte(255 - i)
+	}
+	largest := bytes.Repeat(all, FRAME_MAX_PAYLOAD/len(all))
+	return [][]byte{all, reversed, {0x00}, {0xff, 0x00, '\r', '\n'}, largest}
+}
+
+func TestTunnelByteExact(t *testing.T) {
+	_, agent, url := newTestBroker(t)
+	ws := dialBrowser(t, url, "")
+	conn := agent.next(t)
+	payloads := testPayloads()
+	want := bytes.Join(payloads, nil)
+
+	// Browser to agent
+	go func() {
+		for i, p := range payloads {
+			f := Frame{Type: FrameData, Seq: uint32(i + 1), Payload: p}
+			if err := ws.WriteMessage(websocket.BinaryMessage, f.MarshalMessage()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if got := readAgentData(t, conn, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("agent received %d bytes that differ from the %d sent", len(got), len(want))
+	}
+
+	// Agent to browser
+	go func() {
+		for _, p := range payloads {
+			if err := WriteFrame(conn, DataFrame(p)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if got := readData(t, ws, 0, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("browser received %d bytes that differ from the %d sent", len(got), len(want))
+	}
+}
+
+func TestTunnelOversizedFrames(t *testing.T) {
+	_, agent, url := newTestBroker(t)
+	ws := dialBrowser(t, url, "")
+	conn := agent.next(t)
+
+	// A browser message over the limit closes the websocket, not the tunnel
+	sendFrame(t, ws, Frame{Type: FrameData, Seq: 1, Payload: make([]byte, FRAME_MAX_PAYLOAD+1)})
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	ws = dialBrowser(t, url, "?resume=0")
+	sendFrame(t, ws, Frame{Type: FrameData, Seq: 1, Payload: []byte("after")})
+	if got := readAgentData(t, conn, 5); string(got) != "after" {
+		t.Errorf("agent received %q, want %q", got, "after")
+	}
+
+	// An agent frame over the limit drops the agent connection, the data
+	// before it is delivered and the agent is redialed
+	go func() {
+		WriteFrame(conn, DataFrame([]byte("before")))
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header[1:], uint32(FRAME_MAX_PAYLOAD+1))
+		conn.Write(header)
+	}()
+	if got := readData(t, ws, 0, 6); string(got) != "before" {
+		t.Errorf("browser received %q, want %q", got, "before")
+	}
+
+	conn = agent.next(t)
+	go WriteFrame(conn, DataFrame([]byte("redialed")))
+	if got := readData(t, ws, 1, 8); string(got) != "redialed" {
+		t.Errorf("browser received %q, want %q", got, "redialed")
+	}
+}
+
+func TestTunnelResumeAfterAck(t *testing.T) {
+	b, agent, url := newTestBroker(t)
+	ws := dialBrowser(t, url, "")
+	conn := agent.next(t)
+
+	sendFrame(t, ws, Frame{Type: FrameData, Seq: 1, Payload: []byte("x")})
+	if got := readAgentData(t, conn, 1); string(got) != "x" {
+		t.Fatalf("agent received %q, want %q", got, "x")
+	}
+
+	go func() {
+		for _, p := range []string{"a", "b", "c"} {
+			WriteFrame(conn, DataFrame([]byte(p)))
+		}
+	}()
+	if got := readData(t, ws, 0, 3); string(got) != "abc" {
+		t.Fatalf("browser received %q, want %q", got, "abc")
+	}
+	sendFrame(t, ws, Frame{Type: FrameAck, Seq: 2})
+	ws.Close()
+
+	// Output while the browser is away is kept for its return
+	go WriteFrame(conn, DataFrame([]byte("d")))
+	deadline := time.Now().Add(testTimeout)
+	for {
+		stats := b.Stats("session")
+		if len(stats) == 1 && !stats[0].Browser && stats[0].SandboxBytes == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker did not receive the output, stats: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The broker acks what it received and resends what was not acked
+	ws = dialBrowser(t, url, "?resume=2")
+	if f := readFrame(t, ws); f.Type != FrameAck || f.Seq != 1 {
+		t.Fatalf("got frame %+v, want ack 1", f)
+	}
+	if got := readData(t, ws, 2, 2); string(got) != "cd" {
+		t.Errorf("browser received %q after resuming, want %q", got, "cd")
+	}
+
+	// Frames the broker already received are not forwarded again
+	sendFrame(t, ws, Frame{Type: FrameData, Seq: 1, Payload: []byte("x")})
+	sendFrame(t, ws, Frame{Type: FrameData, Seq: 2, Payload: []byte("y")})
+	if got := readAgentData(t, conn, 1); string(got) != "y" {
+		t.Errorf("agent received %q, want %q", got, "y")
+	}
+}
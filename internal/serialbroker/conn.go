@@ -0,0 +1,137 @@
+package serialbroker
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol spoken by a serial agent
+type Protocol string
+
+const (
+	// ProtocolRaw agents, such as socat, only carry serial data. Control
+	// frames are dropped.
+	ProtocolRaw Protocol = "raw"
+	// ProtocolFramed agents use length prefixed frames, see frame.go
+	ProtocolFramed Protocol = "framed"
+)
+
+var (
+	// SUBPROTOCOL_BINARY is the websocket subprotocol of browsers that exchange
+	// unframed serial data as binary messages
+	SUBPROTOCOL_BINARY = "remoto.serial.binary"
+	// Time allowed to write a frame to the browser or the agent, a peer that
+	// stops reading is dropped
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+// Agent describes how to reach the serial agent of a sandbox
+type Agent struct {
+	Port     int
+	Protocol Protocol
+}
+
+// browserConn exchanges frames with the browser. Browsers that did not
+// negotiate the framed protocol only exchange data, as binary messages if
+// they negotiated SUBPROTOCOL_BINARY and as text messages otherwise.
+type browserConn struct {
+	ws     *websocket.Conn
+	framed bool
+	binary bool
+}
+
+func newBrowserConn(ws *websocket.Conn) *browserConn {
+	// A message holds at most one frame
+	ws.SetReadLimit(int64(FRAME_MAX_PAYLOAD) + 5)
+	return &browserConn{
+		ws:     ws,
+		framed: ws.Subprotocol() == SUBPROTOCOL_FRAMED,
+		binary: ws.Subprotocol() == SUBPROTOCOL_FRAMED || ws.Subprotocol() == SUBPROTOCOL_BINARY,
+	}
+}
+
+func (c *browserConn) Close() error {
+	return c.ws.Close()
+}
+
+// ReadFrame reads the next frame, unframed data is accepted as text and binary messages
+func (c *browserConn) ReadFrame() (Frame, error) {
+	_, msg, err := c.ws.ReadMessage()
+	if err != nil {
+		return Frame{}, err
+	}
+	if !c.framed {
+		return DataFrame(msg), nil
+	}
+	return UnmarshalMessage(msg)
+}
+
+// WriteFrame sends the frame, control frames are dropped if the browser is not framed
+func (c *browserConn) WriteFrame(f Frame) error {
+	c.ws.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if !c.framed {
+		if f.Type != FrameData {
+			return nil
+		}
+		return c.ws.WriteMessage(dataMessageType(c.binary), f.Payload)
+	}
+	return c.ws.WriteMessage(websocket.BinaryMessage, f.MarshalMessage())
+}
+
+// dataMessageType returns the websocket message type of unframed serial data.
+// Text messages are kept for older browsers, browsers decode them as UTF-8
+// which mangles binary data.
+func dataMessageType(binary bool) int {
+	if binary {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// agentConn exchanges frames with the serial agent of a sandbox
+type agentConn struct {
+	conn   net.Conn
+	framed bool
+	buf    []byte
+}
+
+// newAgentConn wraps the connection, data of raw agents is read in chunks of readSize
+func newAgentConn(conn net.Conn, protocol Protocol, readSize int) *agentConn {
+	return &agentConn{
+		conn:   conn,
+		framed: protocol == ProtocolFramed,
+		buf:    make([]byte, readSize),
+	}
+}
+
+// ReadFrame reads the next frame
+func (c *agentConn) ReadFrame() (Frame, error) {
+	if c.framed {
+		return ReadFrame(c.conn)
+	}
+
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		return Frame{}, err
+	}
+	return DataFrame(append([]byte(nil), c.buf[:n]...)), nil
+}
+
+// WriteFrame sends the frame, control frames are dropped if the agent is raw
+func (c *agentConn) WriteFrame(f Frame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if !c.framed {
+		if f.Type != FrameData {
+			return nil
+		}
+		_, err := c.conn.Write(f.Payload)
+		return err
+	}
+	return WriteFrame(c.conn, f)
+}
+
+func (c *agentConn) Close() error {
+	return c.conn.Close()
+}
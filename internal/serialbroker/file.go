@@ -0,0 +1,213 @@
+package serialbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	File uploads
+
+	The broker uploads a file to the agent over the agent connection of a
+	tunnel: a file frame with a start event carrying the name and size, file
+	data frames with the contents and a file frame with an end event, or an
+	error event to abort. The agent answers with progress events and a done
+	or error event. Only one upload runs per tunnel at a time.
+*/
+
+var (
+	ErrInvalidFile       = errors.New("invalid file frame")
+	ErrNotConnected      = errors.New("serial tunnel is not connected to the agent")
+	ErrUploadBusy        = errors.New("another upload is in progress")
+	ErrUploadUnsupported = errors.New("agent does not support uploads")
+	ErrUploadInterrupted = errors.New("agent connection lost during upload")
+	ErrUploadFailed      = errors.New("agent could not place the file")
+	ErrUploadTimeout     = errors.New("agent did not confirm the upload")
+
+	// Size of the file data frames of uploads
+	FILE_CHUNK_SIZE = 16 * 1024
+	// Time the agent has to confirm an upload after the last chunk
+	FILE_DONE_TIMEOUT = 30 * time.Second
+)
+
+// FileEventType ...
+type FileEventType string
+
+const (
+	// FileStart and FileEnd are sent by the broker
+	FileStart FileEventType = "start"
+	FileEnd   FileEventType = "end"
+	// FileProgress and FileDone are sent by the agent
+	FileProgress FileEventType = "progress"
+	FileDone     FileEventType = "done"
+	// FileError is sent by the agent when it fails, or by the broker to abort
+	FileError FileEventType = "error"
+)
+
+// FileEvent is the payload of a file frame, only the fields of its type are set
+type FileEvent struct {
+	Type FileEventType `json:"type"`
+	Name string        `json:"name,omitempty"`
+	Size int64         `json:"size,omitempty"`
+	// Written is the number of bytes the agent wrote so far
+	Written int64 `json:"written,omitempty"`
+	// Path is where the agent placed the file in the sandbox
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Validate checks that the event has a known type and sane values
+func (e FileEvent) Validate() error {
+	switch e.Type {
+	case FileStart:
+		if _, err := CleanFileName(e.Name); err != nil {
+			return err
+		}
+		if e.Size < 0 {
+			return fmt.Errorf("%w: size must not be negative", ErrInvalidFile)
+		}
+	case FileEnd, FileProgress, FileDone, FileError:
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrInvalidFile, e.Type)
+	}
+	return nil
+}
+
+// CleanFileName returns the name if it is a plain file name, without directories
+func CleanFileName(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("%w: invalid file name %q", ErrInvalidFile, name)
+	}
+	return name, nil
+}
+
+// FileFrame ...
+func FileFrame(e FileEvent) (Frame, error) {
+	if err := e.Validate(); err != nil {
+		return Frame{}, err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: FrameFile, Payload: payload}, nil
+}
+
+// FileEvent decodes and validates the payload of a file frame
+func (f Frame) FileEvent() (FileEvent, error) {
+	var e FileEvent
+	if f.Type != FrameFile {
+		return e, fmt.Errorf("%w: not a file frame", ErrInvalidFile)
+	}
+	if err := json.Unmarshal(f.Payload, &e); err != nil {
+		return e, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+	}
+	return e, e.Validate()
+}
+
+// upload sends a file to the agent and waits until it is placed in the sandbox
+func (t *tunnel) upload(name string, size int64, r io.Reader) (FileEvent, error) {
+	start, err := FileFrame(FileEvent{Type: FileStart, Name: name, Size: size})
+	if err != nil {
+		return FileEvent{}, err
+	}
+
+	t.lock.Lock()
+	agent := t.agent
+	switch {
+	case agent == nil:
+		t.lock.Unlock()
+		return FileEvent{}, ErrNotConnected
+	case !agent.framed:
+		t.lock.Unlock()
+		return FileEvent{}, ErrUploadUnsupported
+	case t.uploadEvents != nil:
+		t.lock.Unlock()
+		return FileEvent{}, ErrUploadBusy
+	}
+	events := make(chan FileEvent, 1)
+	t.uploadEvents = events
+	t.lock.Unlock()
+
+	defer func() {
+		t.lock.Lock()
+		t.uploadEvents = nil
+		t.lock.Unlock()
+	}()
+
+	if err := t.writeUpload(agent, start); err != nil {
+		return FileEvent{}, err
+	}
+
+	buf := make([]byte, FILE_CHUNK_SIZE)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunk := Frame{Type: FrameFileData, Payload: append([]byte(nil), buf[:n]...)}
+			if err := t.writeUpload(agent, chunk); err != nil {
+				return FileEvent{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			abort, _ := FileFrame(FileEvent{Type: FileError, Error: err.Error()})
+			t.writeUpload(agent, abort)
+			return FileEvent{}, err
+		}
+	}
+
+	end, _ := FileFrame(FileEvent{Type: FileEnd})
+	if err := t.writeUpload(agent, end); err != nil {
+		return FileEvent{}, err
+	}
+
+	select {
+	case e := <-events:
+		if e.Type == FileError {
+			return e, fmt.Errorf("%w: %s", ErrUploadFailed, e.Error)
+		}
+		return e, nil
+	case <-time.After(FILE_DONE_TIMEOUT):
+		return FileEvent{}, ErrUploadTimeout
+	}
+}
+
+// writeUpload sends a frame of an upload, the upload fails if the agent
+// connection changed since it started
+func (t *tunnel) writeUpload(agent *agentConn, f Frame) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.agent != agent {
+		return ErrUploadInterrupted
+	}
+	if err := agent.WriteFrame(f); err != nil {
+		log.Printf("[SerialTunnel] (%s) Error writing to agent: %v\n", t.name, err)
+		agent.Close()
+		t.agent = nil
+		t.space.Broadcast()
+		t.ensureAgent()
+		return ErrUploadInterrupted
+	}
+	return nil
+}
+
+// uploadEvent passes the outcome of an upload to the waiting upload, the
+// tunnel lock must be held
+func (t *tunnel) uploadEvent(e FileEvent) {
+	if t.uploadEvents == nil || (e.Type != FileDone && e.Type != FileError) {
+		return
+	}
+	select {
+	case t.uploadEvents <- e:
+	default:
+	}
+}
@@ -0,0 +1,217 @@
+package serialbroker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	Framed serial protocol
+
+	Browsers that negotiate the SUBPROTOCOL_FRAMED websocket subprotocol send
+	and receive one frame per binary message: a single type byte, the sequence
+	number as a big endian uint32 and the payload.
+
+	Sequence numbers count the data and control frames sent in each direction
+	of a session, starting at 1. Ack frames carry the sequence number of the
+	last frame received and have no payload. A reconnecting browser passes the
+	last sequence number it received as the resume query parameter, the broker
+	then answers with an ack and resends what the browser missed. The browser
+	resends everything after the broker's ack, duplicates are dropped.
+
+	Framed agents use the same frames over TCP, with the payload length as a
+	big endian uint32 between the type byte and the payload.
+
+	Data frames carry serial bytes, control frames carry a JSON encoded Control.
+
+	Framed agents start every connection with a hello frame carrying a random
+	challenge, which the broker answers with an auth frame, see auth.go.
+*/
+
+var (
+	ErrInvalidFrame   = errors.New("invalid frame")
+	ErrInvalidControl = errors.New("invalid control frame")
+
+	// SUBPROTOCOL_FRAMED is the websocket subprotocol of the framed protocol
+	SUBPROTOCOL_FRAMED = "remoto.serial.v2"
+	// Largest payload accepted from an agent
+	FRAME_MAX_PAYLOAD = 64 * 1024
+)
+
+// FrameType ...
+type FrameType byte
+
+const (
+	FrameData    FrameType = 0x00
+	FrameControl FrameType = 0x01
+	// FrameHello and FrameAuth are only exchanged with agents
+	FrameHello FrameType = 0x02
+	FrameAuth  FrameType = 0x03
+	// FrameAck is only exchanged with browsers
+	FrameAck FrameType = 0x04
+	// FrameFile and FrameFileData upload files to agents, see file.go. Agents
+	// report progress with file frames, which are forwarded to browsers.
+	FrameFile     FrameType = 0x05
+	FrameFileData FrameType = 0x06
+)
+
+// Frame is a unit of the framed serial protocol
+type Frame struct {
+	Type FrameType
+	// Seq is only used between browsers and the broker
+	Seq     uint32
+	Payload []byte
+}
+
+// ControlType ...
+type ControlType string
+
+const (
+	// ControlLine changes the line settings of the serial port
+	ControlLine ControlType = "line"
+	// ControlSignals sets the modem signals of the serial port
+	ControlSignals ControlType = "signals"
+	// ControlBreak sends a break
+	ControlBreak ControlType = "break"
+)
+
+// Control is the payload of a control frame, only the fields of its type are set
+type Control struct {
+	Type ControlType `json:"type"`
+
+	// Line settings
+	BaudRate int    `json:"baudRate,omitempty"`
+	DataBits int    `json:"dataBits,omitempty"`
+	StopBits int    `json:"stopBits,omitempty"`
+	Parity   string `json:"parity,omitempty"`
+
+	// Modem signals, nil leaves a signal unchanged
+	DTR *bool `json:"dtr,omitempty"`
+	RTS *bool `json:"rts,omitempty"`
+
+	// Duration of a break in milliseconds
+	Duration int `json:"duration,omitempty"`
+}
+
+// Validate checks that the control has a known type and sane values
+func (c Control) Validate() error {
+	switch c.Type {
+	case ControlLine:
+		if c.BaudRate <= 0 {
+			return fmt.Errorf("%w: baud rate must be positive", ErrInvalidControl)
+		}
+		if c.DataBits != 0 && (c.DataBits < 5 || c.DataBits > 8) {
+			return fmt.Errorf("%w: data bits must be between 5 and 8", ErrInvalidControl)
+		}
+		if c.StopBits != 0 && c.StopBits != 1 && c.StopBits != 2 {
+			return fmt.Errorf("%w: stop bits must be 1 or 2", ErrInvalidControl)
+		}
+		switch c.Parity {
+		case "", "none", "even", "odd":
+		default:
+			return fmt.Errorf("%w: unknown parity %s", ErrInvalidControl, c.Parity)
+		}
+	case ControlSignals:
+		if c.DTR == nil && c.RTS == nil {
+			return fmt.Errorf("%w: no signals set", ErrInvalidControl)
+		}
+	case ControlBreak:
+		if c.Duration < 0 || c.Duration > 5000 {
+			return fmt.Errorf("%w: break duration must be between 0 and 5000 ms", ErrInvalidControl)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrInvalidControl, c.Type)
+	}
+	return nil
+}
+
+// DataFrame ...
+func DataFrame(data []byte) Frame {
+	return Frame{Type: FrameData, Payload: data}
+}
+
+// ControlFrame ...
+func ControlFrame(c Control) (Frame, error) {
+	if err := c.Validate(); err != nil {
+		return Frame{}, err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: FrameControl, Payload: payload}, nil
+}
+
+// Control decodes and validates the payload of a control frame
+func (f Frame) Control() (Control, error) {
+	var c Control
+	if f.Type != FrameControl {
+		return c, fmt.Errorf("%w: not a control frame", ErrInvalidControl)
+	}
+	if err := json.Unmarshal(f.Payload, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidControl, err)
+	}
+	return c, c.Validate()
+}
+
+// MarshalMessage encodes the frame as a websocket message
+func (f Frame) MarshalMessage() []byte {
+	msg := make([]byte, 5+len(f.Payload))
+	msg[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(msg[1:], f.Seq)
+	copy(msg[5:], f.Payload)
+	return msg
+}
+
+// UnmarshalMessage decodes a frame from a websocket message
+func UnmarshalMessage(msg []byte) (Frame, error) {
+	if len(msg) < 5 {
+		return Frame{}, fmt.Errorf("%w: message too short", ErrInvalidFrame)
+	}
+	f := Frame{
+		Type:    FrameType(msg[0]),
+		Seq:     binary.BigEndian.Uint32(msg[1:]),
+		Payload: msg[5:],
+	}
+	if f.Type != FrameData && f.Type != FrameControl && f.Type != FrameAck {
+		return Frame{}, fmt.Errorf("%w: unknown type %d", ErrInvalidFrame, msg[0])
+	}
+	return f, nil
+}
+
+// WriteFrame writes a length prefixed frame, as used by framed agents
+func WriteFrame(w io.Writer, f Frame) error {
+	header := make([]byte, 5)
+	header[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(f.Payload)))
+
+	// Write in one call, so concurrent writers on a net.Conn do not interleave
+	_, err := w.Write(append(header, f.Payload...))
+	return err
+}
+
+// ReadFrame reads a length prefixed frame, as used by framed agents
+func ReadFrame(r io.Reader) (Frame, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+
+	f := Frame{Type: FrameType(header[0])}
+	if f.Type > FrameFileData || f.Type == FrameAck {
+		return Frame{}, fmt.Errorf("%w: unknown type %d", ErrInvalidFrame, header[0])
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > uint32(FRAME_MAX_PAYLOAD) {
+		return Frame{}, fmt.Errorf("%w: payload of %d bytes exceeds limit", ErrInvalidFrame, length)
+	}
+
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, err
+	}
+	return f, nil
+}
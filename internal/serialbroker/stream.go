@@ -0,0 +1,106 @@
+package serialbroker
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// Entries buffered per tap, slow taps are disconnected
+	TAP_BUFFER_SIZE = 64
+)
+
+// stream holds the serial traffic and the tunnel of a session across websocket connections
+type stream struct {
+	tunnel     *tunnel
+	transcript *Transcript
+	// file is nil if transcripts are not saved to disk
+	file *os.File
+
+	tapsLock sync.Locker
+	taps     map[chan Entry]struct{}
+}
+
+// newStream creates the stream, its transcript is saved as <name>.log
+func newStream(name string, cfg Config, dial dialFunc) *stream {
+	s := &stream{
+		transcript: NewTranscript(cfg.TranscriptSize),
+		tapsLock:   &sync.Mutex{},
+		taps:       map[chan Entry]struct{}{},
+	}
+	s.tunnel = newTunnel(s, dial, cfg)
+
+	if cfg.TranscriptDir != "" {
+		path := filepath.Join(cfg.TranscriptDir, name+".log")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Printf("[SerialTunnel] Could not open transcript %s: %v\n", path, err)
+		} else {
+			s.file = f
+		}
+	}
+
+	return s
+}
+
+// record adds traffic to the transcript and forwards it to the taps
+func (s *stream) record(dir Direction, data []byte) {
+	// Hold the lock while appending, so new taps never receive an entry twice
+	s.tapsLock.Lock()
+	defer s.tapsLock.Unlock()
+
+	entry := s.transcript.Append(dir, data)
+	if s.file != nil {
+		if _, err := entry.WriteTo(s.file); err != nil {
+			log.Printf("[SerialTunnel] Could not write transcript: %v\n", err)
+		}
+	}
+
+	for c := range s.taps {
+		select {
+		case c <- entry:
+		default:
+			delete(s.taps, c)
+			close(c)
+		}
+	}
+}
+
+// subscribe returns the transcript so far, a channel receiving new traffic
+// and a function to unsubscribe. The channel is closed when the tap falls behind.
+func (s *stream) subscribe() ([]Entry, chan Entry, func()) {
+	s.tapsLock.Lock()
+	defer s.tapsLock.Unlock()
+
+	c := make(chan Entry, TAP_BUFFER_SIZE)
+	s.taps[c] = struct{}{}
+
+	return s.transcript.Entries(), c, func() {
+		s.tapsLock.Lock()
+		defer s.tapsLock.Unlock()
+
+		if _, ok := s.taps[c]; ok {
+			delete(s.taps, c)
+			close(c)
+		}
+	}
+}
+
+// close disconnects the tunnel and all taps and closes the transcript file
+func (s *stream) close() {
+	s.tunnel.close()
+
+	s.tapsLock.Lock()
+	defer s.tapsLock.Unlock()
+
+	for c := range s.taps {
+		delete(s.taps, c)
+		close(c)
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
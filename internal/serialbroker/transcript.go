@@ -0,0 +1,80 @@
+package serialbroker
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Direction of serial traffic
+type Direction string
+
+const (
+	// DirectionDevice is output of the device, sent by the browser to the sandbox
+	DirectionDevice Direction = "device"
+	// DirectionSandbox is input for the device, sent by the sandbox to the browser
+	DirectionSandbox Direction = "sandbox"
+)
+
+// Entry is a chunk of serial traffic
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	Data      []byte    `json:"data"`
+}
+
+// WriteTo writes the entry as a single human readable line
+func (e Entry) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, "%s %s %s\n", e.Time.Format(time.RFC3339Nano), e.Direction, strconv.Quote(string(e.Data)))
+	return int64(n), err
+}
+
+// Transcript keeps the most recent serial traffic, bounded by the number of
+// bytes. The oldest entries are dropped first.
+type Transcript struct {
+	lock    sync.Locker
+	entries []Entry
+	size    int
+	limit   int
+}
+
+func NewTranscript(limit int) *Transcript {
+	return &Transcript{
+		lock:  &sync.Mutex{},
+		limit: limit,
+	}
+}
+
+// Append adds a copy of the data to the transcript
+func (t *Transcript) Append(dir Direction, data []byte) Entry {
+	entry := Entry{
+		Time:      time.Now(),
+		Direction: dir,
+		Data:      append([]byte(nil), data...),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.entries = append(t.entries, entry)
+	t.size += len(entry.Data)
+	for t.size > t.limit && len(t.entries) > 0 {
+		t.size -= len(t.entries[0].Data)
+		t.entries[0] = Entry{}
+		t.entries = t.entries[1:]
+	}
+
+	return entry
+}
+
+// Entries returns a copy of the transcript
+func (t *Transcript) Entries() []Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entries := make([]Entry, len(t.entries))
+	copy(entries, t.entries)
+	return entries
+}
@@ -0,0 +1,432 @@
+package serialbroker
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// Minimum time between acks sent to the browser
+	ACK_INTERVAL = 100 * time.Millisecond
+	// Delay between attempts to dial the agent, doubled up to REDIAL_MAX_INTERVAL
+	REDIAL_INTERVAL     = 500 * time.Millisecond
+	REDIAL_MAX_INTERVAL = 10 * time.Second
+)
+
+type dialFunc func(ip net.IP) (*agentConn, error)
+
+// tunnel connects the browser of a session to the agent of its sandbox. The
+// agent connection outlives the browser connection for a grace period, so a
+// reconnecting browser resumes where it left off. A failed agent connection
+// is redialed.
+//
+// Both directions are bounded by the buffer size. The agent is not read while
+// a connected browser has that many bytes unacknowledged, and the browser is
+// not read while that many bytes wait for the agent to be redialed, so a slow
+// side holds back the other instead of growing memory.
+type tunnel struct {
+	lock       sync.Locker
+	stream     *stream
+	dial       dialFunc
+	grace      time.Duration
+	bufferSize int
+	// space is signalled when the queues shrink or the connections change
+	space *sync.Cond
+
+	name       string
+	ip         net.IP
+	browser    *browserConn
+	agent      *agentConn
+	dialing    bool
+	closed     bool
+	graceTimer *time.Timer
+
+	// Frames for the browser, kept until acknowledged
+	outSeq      uint32
+	outbox      []Frame
+	outboxBytes int
+	// Last frame received from the browser
+	inSeq   uint32
+	lastAck time.Time
+	// Frames for the agent, kept while it is unreachable
+	pending      []Frame
+	pendingBytes int
+	// Data forwarded in both directions
+	deviceBytes  uint64
+	sandboxBytes uint64
+	// uploadEvents receives the outcome of the running upload, nil if idle
+	uploadEvents chan FileEvent
+}
+
+func newTunnel(s *stream, dial dialFunc, cfg Config) *tunnel {
+	lock := &sync.Mutex{}
+	return &tunnel{
+		lock:       lock,
+		stream:     s,
+		dial:       dial,
+		grace:      cfg.GracePeriod,
+		bufferSize: cfg.BufferSize,
+		space:      sync.NewCond(lock),
+	}
+}
+
+// attach connects a browser to the tunnel, replacing the current browser.
+// Resume is the last sequence number the browser received, nil for a new browser.
+func (t *tunnel) attach(browser *browserConn, name string, ip net.IP, resume *uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		browser.Close()
+		return
+	}
+	if t.browser != nil {
+		t.browser.Close()
+	}
+	if t.graceTimer != nil {
+		t.graceTimer.Stop()
+		t.graceTimer = nil
+	}
+	t.browser = browser
+	t.name = name
+	t.space.Broadcast()
+
+	// Admins can connect the same session to another sandbox
+	if !t.ip.Equal(ip) {
+		if t.agent != nil {
+			t.agent.Close()
+			t.agent = nil
+		}
+		t.ip = ip
+		t.pending = nil
+		t.pendingBytes = 0
+	}
+	t.ensureAgent()
+
+	if browser.framed {
+		if resume != nil {
+			// The tunnel was forgotten, continue the numbering of the browser
+			if *resume > t.outSeq {
+				t.outSeq = *resume
+			}
+			t.ack(*resume)
+		} else {
+			t.inSeq = 0
+		}
+		if t.writeBrowser(Frame{Type: FrameAck, Seq: t.inSeq}) != nil {
+			return
+		}
+	}
+
+	// Resend what the browser missed
+	for _, f := range t.outbox {
+		if t.writeBrowser(f) != nil {
+			return
+		}
+	}
+}
+
+// detach disconnects the browser, the agent connection is kept for the grace period
+func (t *tunnel) detach(browser *browserConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.browser != browser {
+		return
+	}
+	t.browser = nil
+	t.space.Broadcast()
+	t.startGrace()
+}
+
+func (t *tunnel) fromBrowser(browser *browserConn, f Frame) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.browser != browser {
+		return
+	}
+	if f.Type == FrameAck {
+		t.ack(f.Seq)
+		return
+	}
+
+	if browser.framed {
+		// Resent after a reconnect
+		if f.Seq <= t.inSeq {
+			return
+		}
+		t.inSeq = f.Seq
+		if time.Since(t.lastAck) >= ACK_INTERVAL {
+			t.writeBrowser(Frame{Type: FrameAck, Seq: t.inSeq})
+		}
+	}
+
+	if f.Type == FrameData {
+		t.deviceBytes += uint64(len(f.Payload))
+		t.stream.record(DirectionDevice, f.Payload)
+	}
+	t.writeAgent(f)
+
+	// Stop reading the browser while the agent is unreachable and the pending frames are full
+	for t.browser == browser && t.agent == nil && !t.closed && t.pendingBytes >= t.bufferSize {
+		t.space.Wait()
+	}
+}
+
+func (t *tunnel) fromAgent(agent *agentConn, f Frame) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Stop reading the agent while the connected browser falls behind, the
+	// agent keeps its output meanwhile
+	for t.agent == agent && t.browser != nil && t.outboxBytes >= t.bufferSize {
+		t.space.Wait()
+	}
+	if t.agent != agent {
+		return
+	}
+
+	t.outSeq++
+	f.Seq = t.outSeq
+	if f.Type == FrameData {
+		t.sandboxBytes += uint64(len(f.Payload))
+		t.stream.record(DirectionSandbox, f.Payload)
+	}
+	if f.Type == FrameFile {
+		e, _ := f.FileEvent()
+		t.uploadEvent(e)
+	}
+
+	// Without a browser the output is kept for its return, the oldest is dropped
+	t.outbox = append(t.outbox, f)
+	t.outboxBytes += len(f.Payload)
+	for len(t.outbox) > 1 && t.outboxBytes > t.bufferSize {
+		log.Printf("[SerialTunnel] (%s) Browser is away, dropping frame %d\n", t.name, t.outbox[0].Seq)
+		t.outboxBytes -= len(t.outbox[0].Payload)
+		t.outbox = t.outbox[1:]
+	}
+	t.writeBrowser(f)
+}
+
+// writeBrowser sends a frame to the browser, dropping the browser on failure.
+// Browsers that are not framed cannot acknowledge frames, frames are
+// considered acknowledged once sent.
+func (t *tunnel) writeBrowser(f Frame) error {
+	if t.browser == nil {
+		return nil
+	}
+
+	if f.Type == FrameAck {
+		t.lastAck = time.Now()
+	}
+	if err := t.browser.WriteFrame(f); err != nil {
+		log.Printf("[SerialTunnel] (%s) Error writing to browser: %v\n", t.name, err)
+		t.browser.Close()
+		t.browser = nil
+		t.space.Broadcast()
+		t.startGrace()
+		return err
+	}
+	if !t.browser.framed {
+		t.ack(f.Seq)
+	}
+	return nil
+}
+
+// writeAgent sends a frame to the agent, or keeps it until the agent is redialed
+func (t *tunnel) writeAgent(f Frame) {
+	if t.agent != nil {
+		err := t.agent.WriteFrame(f)
+		if err == nil {
+			return
+		}
+		log.Printf("[SerialTunnel] (%s) Error writing to agent: %v\n", t.name, err)
+		t.agent.Close()
+		t.agent = nil
+		t.space.Broadcast()
+		t.ensureAgent()
+	}
+
+	// The browser is held back once the pending frames are full, the oldest
+	// are only dropped for frames the browser sent before
+	t.pending = append(t.pending, f)
+	t.pendingBytes += len(f.Payload)
+	for len(t.pending) > 1 && t.pendingBytes > t.bufferSize {
+		log.Printf("[SerialTunnel] (%s) Agent unreachable, dropping frame\n", t.name)
+		t.pendingBytes -= len(t.pending[0].Payload)
+		t.pending = t.pending[1:]
+	}
+}
+
+// ack drops the frames the browser received
+func (t *tunnel) ack(seq uint32) {
+	n := 0
+	for n < len(t.outbox) && t.outbox[n].Seq <= seq {
+		t.outboxBytes -= len(t.outbox[n].Payload)
+		n++
+	}
+	t.outbox = t.outbox[n:]
+	if n > 0 {
+		t.space.Broadcast()
+	}
+}
+
+func (t *tunnel) startGrace() {
+	if t.graceTimer == nil && !t.closed {
+		t.graceTimer = time.AfterFunc(t.grace, t.expire)
+	}
+}
+
+// expire closes the agent connection if no browser returned within the grace period
+func (t *tunnel) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.browser != nil || t.graceTimer == nil {
+		return
+	}
+	t.graceTimer = nil
+	if t.agent != nil {
+		log.Printf("[SerialTunnel] (%s) Browser did not return, closing agent connection\n", t.name)
+		t.agent.Close()
+		t.agent = nil
+	}
+	t.pending = nil
+	t.pendingBytes = 0
+	t.space.Broadcast()
+}
+
+// wanted returns true while a browser is connected or may return
+func (t *tunnel) wanted() bool {
+	return !t.closed && t.ip != nil && (t.browser != nil || t.graceTimer != nil)
+}
+
+func (t *tunnel) ensureAgent() {
+	if t.agent == nil && !t.dialing && t.wanted() {
+		t.dialing = true
+		go t.redial()
+	}
+}
+
+// redial dials the agent until it succeeds or the agent is no longer wanted
+func (t *tunnel) redial() {
+	interval := REDIAL_INTERVAL
+	for {
+		t.lock.Lock()
+		if !t.wanted() {
+			t.dialing = false
+			t.lock.Unlock()
+			return
+		}
+		ip := t.ip
+		t.lock.Unlock()
+
+		agent, err := t.dial(ip)
+
+		t.lock.Lock()
+		if err == nil && t.wanted() && t.ip.Equal(ip) {
+			log.Printf("[SerialTunnel] (%s) Connected to agent (%s)\n", t.name, ip)
+			t.agent = agent
+			t.dialing = false
+			go t.readAgent(agent)
+
+			pending := t.pending
+			t.pending = nil
+			t.pendingBytes = 0
+			for _, f := range pending {
+				t.writeAgent(f)
+			}
+			t.space.Broadcast()
+			t.lock.Unlock()
+			return
+		}
+		if err != nil {
+			log.Printf("[SerialTunnel] (%s) Failed to connect to agent (%s): %v\n", t.name, ip, err)
+		} else {
+			agent.Close()
+		}
+		t.lock.Unlock()
+
+		time.Sleep(interval)
+		if interval *= 2; interval > REDIAL_MAX_INTERVAL {
+			interval = REDIAL_MAX_INTERVAL
+		}
+	}
+}
+
+func (t *tunnel) readAgent(agent *agentConn) {
+	for {
+		f, err := agent.ReadFrame()
+		if err != nil {
+			break
+		}
+		if !validFrame(f) {
+			continue
+		}
+		t.fromAgent(agent, f)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.agent == agent {
+		log.Printf("[SerialTunnel] (%s) Lost connection to agent\n", t.name)
+		agent.Close()
+		t.agent = nil
+		t.space.Broadcast()
+		t.uploadEvent(FileEvent{Type: FileError, Error: ErrUploadInterrupted.Error()})
+		t.ensureAgent()
+	}
+}
+
+// close disconnects the browser and the agent
+func (t *tunnel) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.graceTimer != nil {
+		t.graceTimer.Stop()
+		t.graceTimer = nil
+	}
+	if t.browser != nil {
+		t.browser.Close()
+		t.browser = nil
+	}
+	if t.agent != nil {
+		t.agent.Close()
+		t.agent = nil
+	}
+	t.space.Broadcast()
+}
+
+// ChannelStats describes the traffic of the serial tunnel of a session channel
+type ChannelStats struct {
+	Channel string
+	// Agent and Browser are true while connected
+	Agent   bool
+	Browser bool
+	// DeviceBytes were sent by the device, SandboxBytes by the sandbox
+	DeviceBytes  uint64
+	SandboxBytes uint64
+	// Buffered bytes wait for the browser to acknowledge them or for the agent
+	// to be redialed
+	Buffered int
+}
+
+func (t *tunnel) stats(channel string) ChannelStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return ChannelStats{
+		Channel:      channel,
+		Agent:        t.agent != nil,
+		Browser:      t.browser != nil,
+		DeviceBytes:  t.deviceBytes,
+		SandboxBytes: t.sandboxBytes,
+		Buffered:     t.outboxBytes + t.pendingBytes,
+	}
+}
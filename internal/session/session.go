@@ -3,10 +3,15 @@ package session
 import (
 	"context"
 	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"sync"
 	"time"
 
 	"remoto.senwize.com/internal/names"
 	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/storage"
 )
 
 const (
@@ -16,64 +21,259 @@ const (
 
 var (
 	ctxSessionKey = struct{}{}
+
+	ErrNotFound = errors.New("session not found")
+
+	// Storage key
+	STORAGE_KEY = "sessions"
+
+	// Activity is persisted at most once per interval, so the idle timeout
+	// holds across restarts without saving on every request
+	TOUCH_PERSIST_INTERVAL = 30 * time.Second
 )
 
 // Session ...
 type Session struct {
 	ID         string
+	WorkshopID string
 	GroupName  string
 	IsAdmin    bool
 	Sandbox    *sandbox.Sandbox
+	CreatedAt  time.Time
 	LastActive time.Time
+
+	// restoredSandboxIP is the sandbox this session had before a restart,
+	// it is bound again once the sandbox is rediscovered
+	restoredSandboxIP net.IP
 }
 
-func (s *Session) Touch() {
-	s.LastActive = time.Now()
+// record is the persisted form of a session
+type record struct {
+	ID         string    `json:"id"`
+	WorkshopID string    `json:"workshopID,omitempty"`
+	GroupName  string    `json:"groupName"`
+	IsAdmin    bool      `json:"isAdmin,omitempty"`
+	SandboxIP  net.IP    `json:"sandboxIP,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastActive time.Time `json:"lastActive"`
 }
 
-// Service ...
+// Service keeps track of sessions and is safe for concurrent use. Sessions
+// returned by the service are copies, all mutations go through the service.
 type Service struct {
-	store map[string]*Session
+	storeLock sync.Locker
+	store     map[string]*Session
+	storage   storage.Store
+	persisted time.Time
 }
 
-func New() *Service {
-	return &Service{
-		store: map[string]*Session{},
+func New(store storage.Store) *Service {
+	s := &Service{
+		storeLock: &sync.Mutex{},
+		store:     map[string]*Session{},
+		storage:   store,
 	}
+	s.restore()
+	return s
 }
 
 func (s *Service) Get(id string) *Session {
-	return s.store[id]
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	session, ok := s.store[id]
+	if !ok {
+		return nil
+	}
+	return session.snapshot()
 }
 
-func (s *Service) Create(groupName string) *Session {
+// Create creates a session in a workshop, admin sessions without a workshop
+// administer all workshops
+func (s *Service) Create(workshopID, groupName string, isAdmin bool) *Session {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
 	if groupName == "" {
 		groupName = s.generateName()
 	}
 
 	id := createRandomString(SESSION_ID_LENGTH)
+	now := time.Now()
 	session := &Session{
 		ID:         id,
+		WorkshopID: workshopID,
 		GroupName:  groupName,
-		LastActive: time.Now(),
+		IsAdmin:    isAdmin,
+		CreatedAt:  now,
+		LastActive: now,
 	}
 	s.store[id] = session
+	s.persist()
 
-	return session
+	return session.snapshot()
 }
 
 func (s *Service) Delete(id string) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
 	delete(s.store, id)
+	s.persist()
+}
+
+// Expire deletes and returns all sessions that have been inactive for longer
+// than idle or exist for longer than maxAge. A zero duration disables that check.
+func (s *Service) Expire(idle, maxAge time.Duration) []Session {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	now := time.Now()
+	var expired []Session
+	for id, session := range s.store {
+		idleExpired := idle > 0 && now.Sub(session.LastActive) > idle
+		ageExpired := maxAge > 0 && now.Sub(session.CreatedAt) > maxAge
+		if !idleExpired && !ageExpired {
+			continue
+		}
+
+		expired = append(expired, *session.snapshot())
+		delete(s.store, id)
+	}
+
+	if len(expired) > 0 {
+		s.persist()
+	}
+
+	return expired
+}
+
+// Touch marks the session as active
+func (s *Service) Touch(id string) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	session, ok := s.store[id]
+	if !ok {
+		return
+	}
+	session.LastActive = time.Now()
+	if session.LastActive.Sub(s.persisted) > TOUCH_PERSIST_INTERVAL {
+		s.persist()
+	}
+}
+
+// SetSandbox binds a sandbox to the session
+func (s *Service) SetSandbox(id string, sandbox *sandbox.Sandbox) error {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	session, ok := s.store[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	session.Sandbox = copySandbox(sandbox)
+	session.restoredSandboxIP = nil
+	s.persist()
+
+	return nil
+}
+
+// BindRestored binds a rediscovered sandbox to the session that held it
+// before a restart. It returns the session that was bound, or nil.
+func (s *Service) BindRestored(sandbox *sandbox.Sandbox) *Session {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, session := range s.store {
+		if session.restoredSandboxIP == nil || !session.restoredSandboxIP.Equal(sandbox.IP) {
+			continue
+		}
+
+		session.Sandbox = copySandbox(sandbox)
+		session.restoredSandboxIP = nil
+		return session.snapshot()
+	}
+	return nil
+}
+
+// BySandbox returns the session the sandbox is bound to, or nil
+func (s *Service) BySandbox(ip net.IP) *Session {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, session := range s.store {
+		if session.Sandbox != nil && session.Sandbox.IP.Equal(ip) {
+			return session.snapshot()
+		}
+	}
+	return nil
 }
 
 func (s *Service) List() []Session {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
 	sessions := make([]Session, 0, len(s.store))
 	for _, session := range s.store {
-		sessions = append(sessions, *session)
+		sessions = append(sessions, *session.snapshot())
 	}
 	return sessions
 }
 
+// restore loads the sessions persisted before the last shutdown
+func (s *Service) restore() {
+	var records []record
+	err := s.storage.Load(STORAGE_KEY, &records)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error while restoring sessions: %v", err)
+		return
+	}
+
+	for _, r := range records {
+		s.store[r.ID] = &Session{
+			ID:                r.ID,
+			WorkshopID:        r.WorkshopID,
+			GroupName:         r.GroupName,
+			IsAdmin:           r.IsAdmin,
+			CreatedAt:         r.CreatedAt,
+			LastActive:        r.LastActive,
+			restoredSandboxIP: r.SandboxIP,
+		}
+	}
+	log.Printf("Restored %d sessions", len(records))
+}
+
+// persist saves all sessions to storage, must be called with the lock held
+func (s *Service) persist() {
+	records := make([]record, 0, len(s.store))
+	for _, session := range s.store {
+		r := record{
+			ID:         session.ID,
+			WorkshopID: session.WorkshopID,
+			GroupName:  session.GroupName,
+			IsAdmin:    session.IsAdmin,
+			CreatedAt:  session.CreatedAt,
+			LastActive: session.LastActive,
+		}
+		if session.Sandbox != nil {
+			r.SandboxIP = session.Sandbox.IP
+		} else {
+			r.SandboxIP = session.restoredSandboxIP
+		}
+		records = append(records, r)
+	}
+
+	if err := s.storage.Save(STORAGE_KEY, records); err != nil {
+		log.Printf("Error while persisting sessions: %v", err)
+	}
+	s.persisted = time.Now()
+}
+
 func (s *Service) nameExists(name string) bool {
 	for _, session := range s.store {
 		if session.GroupName == name {
@@ -115,3 +315,25 @@ func Get(ctx context.Context) *Session {
 	}
 	return v.(*Session)
 }
+
+// snapshot returns a copy of the session that shares no memory with the store
+func (s *Session) snapshot() *Session {
+	snapshot := *s
+	snapshot.Sandbox = copySandbox(s.Sandbox)
+	return &snapshot
+}
+
+// copySandbox copies a sandbox, so the session never shares it with the
+// sandbox service or callers
+func copySandbox(sb *sandbox.Sandbox) *sandbox.Sandbox {
+	if sb == nil {
+		return nil
+	}
+	c := *sb
+	return &c
+}
+
+// CanAdminister returns true if the session is an admin of the workshop
+func (s *Session) CanAdminister(workshopID string) bool {
+	return s.IsAdmin && (s.WorkshopID == "" || s.WorkshopID == workshopID)
+}
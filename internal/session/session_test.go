@@ -0,0 +1,125 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"remoto.senwize.com/internal/sandbox"
+	"remoto.senwize.com/internal/storage"
+)
+
+// TestConcurrentAccess hammers the service from many goroutines, run it with
+// go test -race to detect unsynchronized access
+func TestConcurrentAccess(t *testing.T) {
+	s := New(storage.NewMemory())
+
+	const workers = 16
+	const rounds = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				ses := s.Create("workshop", fmt.Sprintf("group-%d-%d", w, r), false)
+				s.Touch(ses.ID)
+
+				sb := &sandbox.Sandbox{IP: net.IPv4(10, 0, byte(w), byte(r)), Reserved: true}
+				if err := s.SetSandbox(ses.ID, sb); err != nil {
+					t.Errorf("SetSandbox: %v", err)
+					return
+				}
+				// The caller keeps ownership of its sandbox
+				sb.Reserved = false
+
+				got := s.Get(ses.ID)
+				if got == nil || got.Sandbox == nil || !got.Sandbox.IP.Equal(sb.IP) {
+					t.Errorf("Get returned %+v, want sandbox %s", got, sb.IP)
+					return
+				}
+				// Snapshots can be modified without affecting the store
+				got.Sandbox.Workshop = "changed"
+				got.GroupName = "changed"
+
+				for _, listed := range s.List() {
+					if listed.Sandbox != nil {
+						_ = listed.Sandbox.IP.String()
+					}
+				}
+
+				s.Touch(ses.ID)
+				s.Delete(ses.ID)
+				if s.Get(ses.ID) != nil {
+					t.Errorf("session %s still exists after Delete", ses.ID)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Expire and bind concurrently with the workers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			s.Expire(0, 0)
+			s.BindRestored(&sandbox.Sandbox{IP: net.IPv4(10, 1, 0, byte(r))})
+		}
+	}()
+	wg.Wait()
+
+	if n := len(s.List()); n != 0 {
+		t.Errorf("%d sessions left, want 0", n)
+	}
+}
+
+// TestSnapshotIsolation checks that sessions returned by the service share no
+// memory with the store
+func TestSnapshotIsolation(t *testing.T) {
+	s := New(storage.NewMemory())
+	ses := s.Create("workshop", "group", false)
+
+	sb := &sandbox.Sandbox{IP: net.IPv4(10, 0, 0, 1), Reserved: true}
+	if err := s.SetSandbox(ses.ID, sb); err != nil {
+		t.Fatal(err)
+	}
+	sb.Workshop = "caller"
+
+	got := s.Get(ses.ID)
+	got.Sandbox.Reserved = false
+	got.Sandbox.IP = net.IPv4(10, 0, 0, 2)
+
+	for _, listed := range []Session{*s.Get(ses.ID), s.List()[0]} {
+		if listed.Sandbox == nil {
+			t.Fatal("sandbox was not kept")
+		}
+		if !listed.Sandbox.Reserved || !listed.Sandbox.IP.Equal(net.IPv4(10, 0, 0, 1)) || listed.Sandbox.Workshop != "" {
+			t.Errorf("stored sandbox was modified through a copy: %+v", listed.Sandbox)
+		}
+	}
+}
+
+// TestTouchPersists checks that activity survives a restart
+func TestTouchPersists(t *testing.T) {
+	store := storage.NewMemory()
+	s := New(store)
+	ses := s.Create("workshop", "group", false)
+
+	defer func(interval time.Duration) { TOUCH_PERSIST_INTERVAL = interval }(TOUCH_PERSIST_INTERVAL)
+	TOUCH_PERSIST_INTERVAL = 0
+	time.Sleep(time.Millisecond)
+	s.Touch(ses.ID)
+	touched := s.Get(ses.ID).LastActive
+
+	restored := New(store).Get(ses.ID)
+	if restored == nil {
+		t.Fatal("session was not restored")
+	}
+	if !restored.LastActive.Equal(touched) {
+		t.Errorf("restored last activity %s, want %s", restored.LastActive, touched)
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps every key as a JSON file in a directory
+type FileStore struct {
+	dirLock sync.Locker
+	dir     string
+}
+
+func NewFile(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create state directory: %w", err)
+	}
+
+	return &FileStore{
+		dirLock: &sync.Mutex{},
+		dir:     dir,
+	}, nil
+}
+
+func (s *FileStore) Load(key string, v interface{}) error {
+	s.dirLock.Lock()
+	defer s.dirLock.Unlock()
+
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *FileStore) Save(key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.dirLock.Lock()
+	defer s.dirLock.Unlock()
+
+	// Write to a temporary file first so a crash never leaves a half written file
+	tmp := s.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryStore keeps values in memory, nothing survives a restart
+type MemoryStore struct {
+	storeLock sync.Locker
+	store     map[string][]byte
+}
+
+func NewMemory() *MemoryStore {
+	return &MemoryStore{
+		storeLock: &sync.Mutex{},
+		store:     map[string][]byte{},
+	}
+}
+
+func (s *MemoryStore) Load(key string, v interface{}) error {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	data, ok := s.store[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *MemoryStore) Save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	s.store[key] = data
+	return nil
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+)
+
+/*
+	The storage package persists service state, so sessions and sandbox
+	reservations survive a restart of the control server.
+*/
+
+var (
+	ErrNotFound = errors.New("key not found")
+)
+
+// Store persists values by key
+type Store interface {
+	// Load decodes the value stored under key into v, returns ErrNotFound if
+	// nothing was stored under key
+	Load(key string, v interface{}) error
+	// Save stores v under key, replacing any previous value
+	Save(key string, v interface{}) error
+}
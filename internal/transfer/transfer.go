@@ -0,0 +1,258 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The transfer service keeps a directory of files for every session. guacd
+	redirects the directory as a drive into RDP sandboxes, so files placed in
+	it by the participant or an admin appear in the sandbox and the other way
+	around.
+
+	The quota applies to files stored through the service. guacd writes the
+	files of the sandbox to the directory directly, those writes count towards
+	the usage but are not limited by the quota.
+*/
+
+var (
+	ErrNotFound      = errors.New("file not found")
+	ErrInvalidName   = errors.New("invalid file name")
+	ErrQuotaExceeded = errors.New("transfer quota exceeded")
+
+	// Longest file name accepted
+	MAX_NAME_LENGTH = 255
+
+	// Session directories and files are shared with the group of guacd, files
+	// created by guacd inherit the group of the directory
+	DIR_MODE  = 0o770 | os.ModeSetgid
+	FILE_MODE = os.FileMode(0o660)
+)
+
+// File describes a file in a transfer directory
+type File struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Service ...
+type Service struct {
+	dir   string
+	quota int64
+	// gid is the group session directories and files are given, -1 keeps the
+	// group of the server
+	gid int
+
+	// writeLock serializes storing uploads, so two uploads cannot both pass
+	// the quota. It is not held while uploads are received.
+	writeLock sync.Locker
+}
+
+// New creates the service, every session may store up to quota bytes. Files
+// are shared with group gid, which guacd must be a member of, unless it is -1.
+func New(dir string, quota int64, gid int) (*Service, error) {
+	// guacd traverses the directory as another user, but cannot list the sessions
+	if err := os.MkdirAll(dir, 0o711); err != nil {
+		return nil, fmt.Errorf("could not create transfer directory: %w", err)
+	}
+	return &Service{
+		dir:       dir,
+		quota:     quota,
+		gid:       gid,
+		writeLock: &sync.Mutex{},
+	}, nil
+}
+
+// Quota returns the number of bytes every session may store
+func (s *Service) Quota() int64 {
+	return s.quota
+}
+
+// Dir returns the transfer directory of a session, relative to the transfer directory
+func Dir(sessionID string) string {
+	return filepath.Base(sessionID)
+}
+
+// ValidName returns false for names that are not plain file names. Hidden
+// files are reserved for uploads in progress.
+func ValidName(name string) bool {
+	return name != "" && len(name) <= MAX_NAME_LENGTH && name == filepath.Base(name) &&
+		!strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// Prepare creates the transfer directory of a session. guacd writes the
+// files of the sandbox to it as another user of the group.
+func (s *Service) Prepare(sessionID string) (string, error) {
+	dir := filepath.Join(s.dir, Dir(sessionID))
+	if err := os.MkdirAll(dir, DIR_MODE.Perm()); err != nil {
+		return "", err
+	}
+	if err := s.share(dir); err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, DIR_MODE)
+}
+
+// share gives a file to the group of guacd
+func (s *Service) share(path string) error {
+	if s.gid < 0 {
+		return nil
+	}
+	return os.Chown(path, -1, s.gid)
+}
+
+func (s *Service) path(sessionID, name string) string {
+	return filepath.Join(s.dir, Dir(sessionID), name)
+}
+
+// List returns the files of a session, sorted by name
+func (s *Service) List(sessionID string) ([]File, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, Dir(sessionID)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []File{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !ValidName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, File{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// Usage returns the number of bytes a session stores
+func (s *Service) Usage(sessionID string) (int64, error) {
+	files, err := s.List(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, f := range files {
+		usage += f.Size
+	}
+	return usage, nil
+}
+
+// remaining returns the number of bytes a session may store as a file, the
+// file it replaces does not count
+func (s *Service) remaining(sessionID, name string) (int64, error) {
+	files, err := s.List(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	remaining := s.quota
+	for _, f := range files {
+		if f.Name != name {
+			remaining -= f.Size
+		}
+	}
+	return remaining, nil
+}
+
+// Save stores a file for a session, replacing a file with the same name.
+// The file is not stored if the session would exceed its quota.
+func (s *Service) Save(sessionID, name string, r io.Reader) (File, error) {
+	if !ValidName(name) {
+		return File{}, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	// The body is received without holding the lock, uploads can be slow
+	remaining, err := s.remaining(sessionID, name)
+	if err != nil {
+		return File{}, err
+	}
+	dir, err := s.Prepare(sessionID)
+	if err != nil {
+		return File{}, err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return File{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, remaining+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return File{}, err
+	}
+
+	// Files saved in the meantime count as well
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if remaining, err = s.remaining(sessionID, name); err != nil {
+		return File{}, err
+	}
+	if n > remaining {
+		return File{}, ErrQuotaExceeded
+	}
+
+	// guacd reads and writes the drive as another user
+	if err := s.share(tmp.Name()); err != nil {
+		return File{}, err
+	}
+	if err := os.Chmod(tmp.Name(), FILE_MODE); err != nil {
+		return File{}, err
+	}
+	if err := os.Rename(tmp.Name(), s.path(sessionID, name)); err != nil {
+		return File{}, err
+	}
+	return File{Name: name, Size: n, ModTime: time.Now()}, nil
+}
+
+// Open opens a file of a session for reading
+func (s *Service) Open(sessionID, name string) (*os.File, error) {
+	if !ValidName(name) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(sessionID, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes a file of a session
+func (s *Service) Delete(sessionID, name string) error {
+	if !ValidName(name) {
+		return ErrNotFound
+	}
+	err := os.Remove(s.path(sessionID, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Forget removes the transfer directory of a session and its files
+func (s *Service) Forget(sessionID string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return os.RemoveAll(filepath.Join(s.dir, Dir(sessionID)))
+}
@@ -0,0 +1,126 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestService(t *testing.T, quota int64) *Service {
+	t.Helper()
+	s, err := New(t.TempDir(), quota, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// within fails the test if fn does not return in time
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("%s is blocked", what)
+	}
+}
+
+// TestStalledUpload checks that an upload whose body stalls does not hold
+// back the uploads of other sessions or removing a session
+func TestStalledUpload(t *testing.T) {
+	s := newTestService(t, 1024)
+
+	body, stall := io.Pipe()
+	stalled := make(chan error, 1)
+	go func() {
+		_, err := s.Save("slow", "slow.txt", body)
+		stalled <- err
+	}()
+	stall.Write([]byte("first part"))
+
+	within(t, "upload of another session", func() {
+		if _, err := s.Save("fast", "fast.txt", strings.NewReader("hello")); err != nil {
+			t.Errorf("Save: %v", err)
+		}
+	})
+	within(t, "Forget", func() {
+		if err := s.Forget("fast"); err != nil {
+			t.Errorf("Forget: %v", err)
+		}
+	})
+
+	stall.Write([]byte(", second part"))
+	stall.Close()
+	select {
+	case err := <-stalled:
+		if err != nil {
+			t.Fatalf("stalled upload failed: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("stalled upload did not finish")
+	}
+
+	f, err := s.Open("slow", "slow.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	if string(data) != "first part, second part" {
+		t.Errorf("stored %q", data)
+	}
+}
+
+// TestConcurrentUploadsQuota checks that uploads received at the same time
+// cannot together exceed the quota
+func TestConcurrentUploadsQuota(t *testing.T) {
+	s := newTestService(t, 100)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	bodies := make([]*io.PipeWriter, 2)
+	for i, name := range []string{"a.bin", "b.bin"} {
+		r, w := io.Pipe()
+		bodies[i] = w
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, errs[i] = s.Save("session", name, r)
+		}(i, name)
+	}
+
+	// Both uploads are received before either is stored
+	for _, w := range bodies {
+		w.Write(bytes.Repeat([]byte("x"), 60))
+	}
+	for _, w := range bodies {
+		w.Close()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if errors.Is(err, ErrQuotaExceeded) {
+			failed++
+		} else if err != nil {
+			t.Errorf("Save: %v", err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d uploads exceeded the quota, want 1", failed)
+	}
+	if usage, _ := s.Usage("session"); usage != 60 {
+		t.Errorf("usage is %d, want 60", usage)
+	}
+}
@@ -0,0 +1,181 @@
+package workshop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"remoto.senwize.com/internal/sandbox"
+)
+
+/*
+	The workshop service is responsible for:
+		- keeping track of the workshops hosted by this control server
+		- matching workshop and admin codes to a workshop
+*/
+
+var (
+	ErrNotFound      = errors.New("workshop not found")
+	ErrNotActive     = errors.New("workshop is not active")
+	ErrDuplicateID   = errors.New("duplicate workshop id")
+	ErrDuplicateCode = errors.New("workshop code is already in use")
+	ErrMissingField  = errors.New("workshop is missing a required field")
+)
+
+// Workshop ...
+type Workshop struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Code is used by groups to join the workshop
+	Code string `json:"code"`
+	// AdminCode is used by trainers to administer only this workshop
+	AdminCode string `json:"adminCode,omitempty"`
+	// Sandboxes is the discovery source of the sandbox pool, see discovery.ParseProvider
+	Sandboxes string `json:"sandboxes"`
+	// Connection overrides the default connection of the sandboxes, empty fields are inherited
+	Connection sandbox.Connection `json:"connection,omitempty"`
+	// StartsAt and EndsAt limit when groups can join, zero means unlimited
+	StartsAt time.Time `json:"startsAt,omitempty"`
+	EndsAt   time.Time `json:"endsAt,omitempty"`
+	// Record enables recording of the groups' remote desktop sessions
+	Record bool `json:"record,omitempty"`
+	// FileTransfer lets groups move files between their browser and the sandbox
+	FileTransfer bool `json:"fileTransfer,omitempty"`
+}
+
+// Active returns true if groups can join the workshop at the given time
+func (w *Workshop) Active(now time.Time) bool {
+	if !w.StartsAt.IsZero() && now.Before(w.StartsAt) {
+		return false
+	}
+	if !w.EndsAt.IsZero() && now.After(w.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// Service ...
+type Service struct {
+	storeLock sync.Locker
+	store     []*Workshop
+}
+
+func New(workshops []Workshop) (*Service, error) {
+	s := &Service{
+		storeLock: &sync.Mutex{},
+	}
+
+	ids := map[string]bool{}
+	codes := map[string]bool{}
+	for ix := range workshops {
+		w := workshops[ix]
+		if w.ID == "" || w.Code == "" || w.Sandboxes == "" {
+			return nil, fmt.Errorf("%w: %q", ErrMissingField, w.ID)
+		}
+		if ids[w.ID] {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateID, w.ID)
+		}
+		ids[w.ID] = true
+
+		// Codes are matched case insensitive, participant and admin codes
+		// share one namespace so a code always means the same workshop and role
+		for _, code := range []string{w.Code, w.AdminCode} {
+			if code == "" {
+				continue
+			}
+			key := strings.ToLower(code)
+			if codes[key] {
+				return nil, fmt.Errorf("%w: %q", ErrDuplicateCode, w.ID)
+			}
+			codes[key] = true
+		}
+		s.store = append(s.store, &w)
+	}
+
+	return s, nil
+}
+
+// Load reads a JSON list of workshops from a file
+func Load(path string) ([]Workshop, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var workshops []Workshop
+	if err := json.Unmarshal(data, &workshops); err != nil {
+		return nil, fmt.Errorf("invalid workshops file %s: %w", path, err)
+	}
+	return workshops, nil
+}
+
+func (s *Service) List() []Workshop {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	workshops := make([]Workshop, len(s.store))
+	for ix, w := range s.store {
+		workshops[ix] = *w
+	}
+	return workshops
+}
+
+func (s *Service) Get(id string) (Workshop, error) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, w := range s.store {
+		if w.ID == id {
+			return *w, nil
+		}
+	}
+	return Workshop{}, ErrNotFound
+}
+
+// ByCode returns the active workshop with the given participant code, or
+// ErrNotActive if the workshop is not active at the given time
+func (s *Service) ByCode(code string, now time.Time) (Workshop, error) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, w := range s.store {
+		if !strings.EqualFold(w.Code, code) {
+			continue
+		}
+		if !w.Active(now) {
+			return Workshop{}, ErrNotActive
+		}
+		return *w, nil
+	}
+	return Workshop{}, ErrNotFound
+}
+
+// HasCode returns true if a workshop uses the code as participant or admin code
+func (s *Service) HasCode(code string) bool {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, w := range s.store {
+		if strings.EqualFold(w.Code, code) || (w.AdminCode != "" && strings.EqualFold(w.AdminCode, code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ByAdminCode returns the workshop with the given admin code
+func (s *Service) ByAdminCode(code string) (Workshop, error) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	for _, w := range s.store {
+		if w.AdminCode != "" && strings.EqualFold(w.AdminCode, code) {
+			return *w, nil
+		}
+	}
+	return Workshop{}, ErrNotFound
+}
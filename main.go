@@ -53,7 +53,10 @@ func main() {
 	wd, _ := os.Getwd()
 	mux.Handle("/", http.FileServer(http.Dir(path.Join(wd, "./client/dist"))))
 	mux.Handle("/websocket-tunnel", wsServer)
-	mux.Handle("/websocket-serial", serialbroker.HandleWebsocket(5000))
+	broker, _ := serialbroker.New(serialbroker.Config{Agent: func(net.IP, string) (serialbroker.Agent, error) {
+		return serialbroker.Agent{Port: 5000, Protocol: serialbroker.ProtocolRaw}, nil
+	}})
+	mux.Handle("/websocket-serial", broker.HandleWebsocket())
 
 	s := &http.Server{
 		Addr:           HOST_ADDR,